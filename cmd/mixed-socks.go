@@ -5,15 +5,14 @@ import (
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/xmapst/mixed-socks"
+	"github.com/xmapst/mixed-socks/internal/component/logs"
 	"github.com/xmapst/mixed-socks/internal/config"
 	"github.com/xmapst/mixed-socks/internal/constant"
 	"github.com/xmapst/mixed-socks/internal/engine"
 	"go.uber.org/automaxprocs/maxprocs"
 	"os"
 	"os/signal"
-	"path"
 	"path/filepath"
-	"strings"
 	"syscall"
 )
 
@@ -34,7 +33,8 @@ func init() {
 	})
 
 	logrus.SetReportCaller(true)
-	logrus.SetFormatter(&ConsoleFormatter{})
+	logrus.SetFormatter(&logs.ConsoleFormatter{})
+	logrus.AddHook(logs.DefaultHook)
 }
 
 func main() {
@@ -70,30 +70,5 @@ func main() {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	<-sigCh
-}
-
-type ConsoleFormatter struct {
-	logrus.TextFormatter
-}
-
-func (c *ConsoleFormatter) TrimFunctionSuffix(s string) string {
-	if strings.Contains(s, ".func") {
-		index := strings.Index(s, ".func")
-		s = s[:index]
-	}
-	return s
-}
-
-func (c *ConsoleFormatter) Format(entry *logrus.Entry) ([]byte, error) {
-	file := path.Base(entry.Caller.File)
-	function := c.TrimFunctionSuffix(path.Base(entry.Caller.Function))
-	logStr := fmt.Sprintf("%s %s %s:%d %s %v\n",
-		entry.Time.Format("2006/01/02 15:04:05"),
-		strings.ToUpper(entry.Level.String()),
-		file,
-		entry.Caller.Line,
-		function,
-		entry.Message,
-	)
-	return []byte(logStr), nil
+	engine.Shutdown()
 }
@@ -0,0 +1,130 @@
+package outbound
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/xmapst/mixed-socks/internal/component/dialer"
+	"github.com/xmapst/mixed-socks/internal/constant"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type Http struct {
+	*Base
+	user           string
+	pass           string
+	tls            bool
+	skipCertVerify bool
+}
+
+type HttpOption struct {
+	BasicOption
+	Name           string
+	Server         string
+	Port           int
+	UserName       string
+	Password       string
+	TLS            bool
+	SkipCertVerify bool
+}
+
+// StreamConn implements constant.ProxyAdapter
+func (h *Http) StreamConn(c net.Conn, metadata *constant.Metadata) (net.Conn, error) {
+	if h.tls {
+		host, _, _ := net.SplitHostPort(h.addr)
+		cc, err := tlsClient(c, host, h.skipCertVerify)
+		if err != nil {
+			return nil, fmt.Errorf("%s tls handshake error: %w", h.addr, err)
+		}
+		c = cc
+	}
+
+	if err := h.shakeHand(metadata, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialContext implements constant.ProxyAdapter
+func (h *Http) DialContext(ctx context.Context, metadata *constant.Metadata, opts ...dialer.Option) (_ constant.Conn, err error) {
+	c, err := dialer.DialContext(ctx, "tcp", h.addr, h.Base.DialOptions(opts...)...)
+	if err != nil {
+		return nil, fmt.Errorf("%s connect error: %w", h.addr, err)
+	}
+	tcpKeepAlive(c)
+
+	defer func(c net.Conn) {
+		if err != nil {
+			_ = c.Close()
+		}
+	}(c)
+
+	c, err = h.StreamConn(c, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewConn(c, h), nil
+}
+
+func (h *Http) shakeHand(metadata *constant.Metadata, rw net.Conn) error {
+	addr := metadata.RemoteAddress()
+	if metadata.Host != "" {
+		addr = net.JoinHostPort(metadata.Host, metadata.DstPort)
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL: &url.URL{
+			Host: addr,
+		},
+		Host: addr,
+		Header: http.Header{
+			"Proxy-Connection": []string{"Keep-Alive"},
+		},
+	}
+
+	if h.user != "" && h.pass != "" {
+		auth := h.user + ":" + h.pass
+		req.Header.Add("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+
+	if err := req.Write(rw); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(rw), req)
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusProxyAuthRequired:
+		return errors.New("HTTP need auth")
+	case http.StatusMethodNotAllowed:
+		return errors.New("CONNECT method not allowed by proxy")
+	default:
+		return fmt.Errorf("can not connect remote err code: %d", resp.StatusCode)
+	}
+}
+
+func NewHttp(option HttpOption) *Http {
+	return &Http{
+		Base: &Base{
+			name:  option.Name,
+			addr:  net.JoinHostPort(option.Server, strconv.Itoa(option.Port)),
+			tp:    constant.Http,
+			iface: option.Interface,
+		},
+		user:           option.UserName,
+		pass:           option.Password,
+		tls:            option.TLS,
+		skipCertVerify: option.SkipCertVerify,
+	}
+}
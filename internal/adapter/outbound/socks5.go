@@ -0,0 +1,91 @@
+package outbound
+
+import (
+	"context"
+	"fmt"
+	"github.com/xmapst/mixed-socks/internal/component/dialer"
+	"github.com/xmapst/mixed-socks/internal/constant"
+	"github.com/xmapst/mixed-socks/internal/transport/socks5"
+	"net"
+	"strconv"
+)
+
+type Socks5 struct {
+	*Base
+	user           string
+	pass           string
+	tls            bool
+	skipCertVerify bool
+}
+
+type Socks5Option struct {
+	BasicOption
+	Name           string
+	Server         string
+	Port           int
+	UserName       string
+	Password       string
+	TLS            bool
+	SkipCertVerify bool
+}
+
+// StreamConn implements constant.ProxyAdapter
+func (ss *Socks5) StreamConn(c net.Conn, metadata *constant.Metadata) (net.Conn, error) {
+	if ss.tls {
+		host, _, _ := net.SplitHostPort(ss.addr)
+		cc, err := tlsClient(c, host, ss.skipCertVerify)
+		if err != nil {
+			return nil, fmt.Errorf("%s tls handshake error: %w", ss.addr, err)
+		}
+		c = cc
+	}
+
+	var user *socks5.User
+	if ss.user != "" {
+		user = &socks5.User{
+			Username: ss.user,
+			Password: ss.pass,
+		}
+	}
+	if _, err := socks5.ClientHandshake(c, serializesSocksAddr(metadata), socks5.CmdConnect, user); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialContext implements constant.ProxyAdapter
+func (ss *Socks5) DialContext(ctx context.Context, metadata *constant.Metadata, opts ...dialer.Option) (_ constant.Conn, err error) {
+	c, err := dialer.DialContext(ctx, "tcp", ss.addr, ss.Base.DialOptions(opts...)...)
+	if err != nil {
+		return nil, fmt.Errorf("%s connect error: %w", ss.addr, err)
+	}
+	tcpKeepAlive(c)
+
+	defer func(c net.Conn) {
+		if err != nil {
+			_ = c.Close()
+		}
+	}(c)
+
+	c, err = ss.StreamConn(c, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewConn(c, ss), nil
+}
+
+func NewSocks5(option Socks5Option) *Socks5 {
+	return &Socks5{
+		Base: &Base{
+			name:  option.Name,
+			addr:  net.JoinHostPort(option.Server, strconv.Itoa(option.Port)),
+			tp:    constant.Socks5,
+			iface: option.Interface,
+		},
+		user:           option.UserName,
+		pass:           option.Password,
+		tls:            option.TLS,
+		skipCertVerify: option.SkipCertVerify,
+	}
+}
@@ -1,7 +1,12 @@
 package outbound
 
 import (
+	"bytes"
+	"crypto/tls"
+	"github.com/xmapst/mixed-socks/internal/constant"
+	"github.com/xmapst/mixed-socks/internal/transport/socks5"
 	"net"
+	"strconv"
 	"time"
 )
 
@@ -11,3 +16,33 @@ func tcpKeepAlive(c net.Conn) {
 		_ = tcp.SetKeepAlivePeriod(30 * time.Second)
 	}
 }
+
+func serializesSocksAddr(metadata *constant.Metadata) []byte {
+	var buf [][]byte
+	aType := uint8(metadata.AddrType())
+	p, _ := strconv.ParseUint(metadata.DstPort, 10, 16)
+	port := []byte{uint8(p >> 8), uint8(p & 0xff)}
+	switch aType {
+	case socks5.AtypDomainName:
+		host := []byte(metadata.Host)
+		buf = [][]byte{{aType, uint8(len(host))}, host, port}
+	case socks5.AtypIPv4:
+		host := metadata.DstIP.To4()
+		buf = [][]byte{{aType}, host, port}
+	case socks5.AtypIPv6:
+		host := metadata.DstIP.To16()
+		buf = [][]byte{{aType}, host, port}
+	}
+	return bytes.Join(buf, nil)
+}
+
+func tlsClient(c net.Conn, serverName string, skipCertVerify bool) (net.Conn, error) {
+	cc := tls.Client(c, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: skipCertVerify,
+	})
+	if err := cc.Handshake(); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
@@ -163,6 +163,25 @@ func (c *LruCache) CloneTo(n *LruCache) {
 	}
 }
 
+// Range calls f sequentially for each element from the least recently used,
+// with its expected expires. If f returns false, range stops the iteration.
+// This method will NOT check the maxAge of element and will NOT update the expires.
+func (c *LruCache) Range(f func(key any, value any, expires time.Time) bool) {
+	c.mu.Lock()
+	entries := make([]*entry, 0, c.lru.Len())
+	for le := c.lru.Front(); le != nil; le = le.Next() {
+		e := le.Value.(*entry)
+		entries = append(entries, &entry{key: e.key, value: e.value, expires: e.expires})
+	}
+	c.mu.Unlock()
+
+	for _, e := range entries {
+		if !f(e.key, e.value, time.Unix(e.expires, 0)) {
+			return
+		}
+	}
+}
+
 func (c *LruCache) get(key any) *entry {
 	c.mu.Lock()
 	defer c.mu.Unlock()
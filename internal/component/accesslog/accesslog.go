@@ -0,0 +1,167 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	FormatJSON     = "json"
+	FormatTemplate = "template"
+)
+
+// Default is the access log of the proxied sessions, disabled until configured
+var Default = &Logger{}
+
+// Record is a finished session, or a dial never connected.
+// Rule is always "direct", there are no routing rules
+type Record struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Inbound     string    `json:"inbound"`
+	Network     string    `json:"network"`
+	User        string    `json:"user"`
+	Client      string    `json:"client"`
+	Host        string    `json:"host"`
+	IP          string    `json:"destinationIP"`
+	Port        string    `json:"destinationPort"`
+	Rule        string    `json:"rule"`
+	Chain       string    `json:"chain"`
+	Upload      int64     `json:"upload"`
+	Download    int64     `json:"download"`
+	DurationMs  int64     `json:"durationMs"`
+	CloseReason string    `json:"closeReason"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Config of the access log, empty Filename means disabled
+type Config struct {
+	Filename   string
+	Format     string
+	Template   string
+	MaxBackups int
+	MaxSize    int
+	MaxAge     int
+	Compress   bool
+}
+
+// Validate return error if the format or template is invalid
+func (c Config) Validate() error {
+	_, err := c.parseTemplate()
+	return err
+}
+
+func (c Config) parseTemplate() (*template.Template, error) {
+	switch c.Format {
+	case "", FormatJSON:
+		return nil, nil
+	case FormatTemplate:
+		if c.Template == "" {
+			return nil, fmt.Errorf("access log template is empty")
+		}
+		return template.New("access").Parse(c.Template)
+	default:
+		return nil, fmt.Errorf("unsupport access log format: %s", c.Format)
+	}
+}
+
+// Logger write a line per record, json or the template
+type Logger struct {
+	mux      sync.Mutex
+	config   Config
+	output   *lumberjack.Logger
+	template *template.Template
+}
+
+// Update apply the config, the file is reopened only if changed
+func (l *Logger) Update(cfg Config) error {
+	tpl, err := cfg.parseTemplate()
+	if err != nil {
+		return err
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.template = tpl
+	if cfg == l.config {
+		return nil
+	}
+	if l.output != nil {
+		_ = l.output.Close()
+		l.output = nil
+	}
+	l.config = cfg
+	if cfg.Filename == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.Filename), 0o755); err != nil {
+		return err
+	}
+	l.output = &lumberjack.Logger{
+		Filename:   cfg.Filename,
+		MaxBackups: cfg.MaxBackups,
+		MaxSize:    cfg.MaxSize,
+		MaxAge:     cfg.MaxAge,
+		Compress:   cfg.Compress,
+		LocalTime:  true,
+	}
+	return nil
+}
+
+// Enabled return whether the records are written
+func (l *Logger) Enabled() bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.output != nil
+}
+
+// Log write the record
+func (l *Logger) Log(record *Record) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.output == nil {
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	if l.template != nil {
+		if err := l.template.Execute(buf, record); err != nil {
+			logrus.Warnf("[AccessLog] execute template failed: %s", err)
+			return
+		}
+		if buf.Len() == 0 || buf.Bytes()[buf.Len()-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	} else if err := json.NewEncoder(buf).Encode(record); err != nil {
+		return
+	}
+	if _, err := l.output.Write(buf.Bytes()); err != nil {
+		logrus.Warnf("[AccessLog] write failed: %s", err)
+	}
+}
+
+// Rotate start a new file
+func (l *Logger) Rotate() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.output != nil {
+		_ = l.output.Rotate()
+	}
+}
+
+// Close the file
+func (l *Logger) Close() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.output != nil {
+		_ = l.output.Close()
+	}
+}
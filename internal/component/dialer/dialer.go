@@ -3,8 +3,12 @@ package dialer
 import (
 	"context"
 	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
 	"github.com/xmapst/mixed-socks/internal/component/resolver"
 	"net"
+	"strings"
+	"time"
 )
 
 func DialContext(ctx context.Context, network, address string, options ...Option) (net.Conn, error) {
@@ -15,20 +19,29 @@ func DialContext(ctx context.Context, network, address string, options ...Option
 			return nil, err
 		}
 
-		var ip net.IP
+		var ips []net.IP
 		switch network {
 		case "tcp4", "udp4":
-			ip, err = resolver.ResolveIPv4(host)
+			ips, err = resolver.LookupIPv4(ctx, host)
 		default:
-			ip, err = resolver.ResolveIPv6(host)
+			ips, err = resolver.LookupIPv6(ctx, host)
 		}
 		if err != nil {
 			return nil, err
 		}
 
-		return dialContext(ctx, network, ip, port, options)
+		return happyEyeballsDialContext(ctx, network[:3], ips, port, false, options)
 	case "tcp", "udp":
-		return dualStackDialContext(ctx, network, address, options)
+		// read once, the preference may be replaced by reload during the dial
+		preference := resolver.GetIPPreference()
+		switch preference {
+		case resolver.IPv4Only:
+			return DialContext(ctx, network+"4", address, options...)
+		case resolver.IPv6Only:
+			return DialContext(ctx, network+"6", address, options...)
+		default:
+			return dualStackDialContext(ctx, network, address, preference, options)
+		}
 	default:
 		return nil, errors.New("network invalid")
 	}
@@ -93,28 +106,133 @@ func dialContext(ctx context.Context, network string, destination net.IP, port s
 	return dialer.DialContext(ctx, network, net.JoinHostPort(destination.String(), port))
 }
 
-func dualStackDialContext(ctx context.Context, network, address string, options []Option) (net.Conn, error) {
+func ipFamily(ipv6 bool) string {
+	if ipv6 {
+		return "6"
+	}
+	return "4"
+}
+
+func dualStackDialContext(ctx context.Context, network, address string, preference resolver.IPPreference, options []Option) (net.Conn, error) {
 	host, port, err := net.SplitHostPort(address)
 	if err != nil {
 		return nil, err
 	}
 
+	preferIPv6 := preference == resolver.PreferIPv6
+	ips, err := lookupDualStack(ctx, host, preferIPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	// dual mode race the first address of both ip versions
+	dual := preference == resolver.DualStack
+	return happyEyeballsDialContext(ctx, network, ips, port, dual, options)
+}
+
+// lookupDualStack resolve both ip versions at the same time, return the addresses
+// interleaved by ip version, the preferred one first (RFC 8305 section 4)
+func lookupDualStack(ctx context.Context, host string, preferIPv6 bool) ([]net.IP, error) {
+	type lookupResult struct {
+		ips  []net.IP
+		err  error
+		ipv6 bool
+	}
+	results := make(chan lookupResult, 2)
+	go func() {
+		ips, err := resolver.LookupIPv4(ctx, host)
+		results <- lookupResult{ips: ips, err: err}
+	}()
+	go func() {
+		ips, err := resolver.LookupIPv6(ctx, host)
+		results <- lookupResult{ips: ips, err: err, ipv6: true}
+	}()
+
+	var preferred, other []net.IP
+	var firstErr error
+	collect := func(res lookupResult) {
+		if res.err != nil {
+			if firstErr == nil || res.ipv6 == preferIPv6 {
+				firstErr = res.err
+			}
+			return
+		}
+		if res.ipv6 == preferIPv6 {
+			preferred = res.ips
+		} else {
+			other = res.ips
+		}
+	}
+
+	select {
+	case res := <-results:
+		collect(res)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// wait the other ip version a moment if got some addresses already,
+	// never let the slow one hold the dial
+	var wait <-chan time.Time
+	if len(preferred) != 0 || len(other) != 0 {
+		timer := time.NewTimer(DefaultResolutionDelay)
+		defer timer.Stop()
+		wait = timer.C
+	}
+	select {
+	case res := <-results:
+		collect(res)
+	case <-wait:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	ips := make([]net.IP, 0, len(preferred)+len(other))
+	for i := 0; i < len(preferred) || i < len(other); i++ {
+		if i < len(preferred) {
+			ips = append(ips, preferred[i])
+		}
+		if i < len(other) {
+			ips = append(ips, other[i])
+		}
+	}
+	if len(ips) == 0 {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("%w: %s", resolver.ErrIPNotFound, host)
+		}
+		return nil, firstErr
+	}
+	return ips, nil
+}
+
+// happyEyeballsDialContext dial the addresses in order, the next one starts after
+// DefaultAttemptDelay or as soon as the previous one failed, and the first connected wins.
+// race the first two addresses at once if raceFirst
+func happyEyeballsDialContext(ctx context.Context, network string, ips []net.IP, port string, raceFirst bool, options []Option) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	returned := make(chan struct{})
 	defer close(returned)
 
 	type dialResult struct {
 		net.Conn
 		error
-		resolved bool
-		ipv6     bool
-		done     bool
+		ip net.IP
 	}
 	results := make(chan dialResult)
-	var primary, fallback dialResult
 
-	startRacer := func(ctx context.Context, network, host string, ipv6 bool) {
-		result := dialResult{ipv6: ipv6, done: true}
-		defer func() {
+	next, pending := 0, 0
+	startNext := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			attemptCtx, attemptCancel := context.WithTimeout(ctx, DefaultAttemptTimeout)
+			defer attemptCancel()
+
+			result := dialResult{ip: ip}
+			result.Conn, result.error = dialContext(attemptCtx, network+ipFamily(ip.To4() == nil), ip, port, options)
 			select {
 			case results <- result:
 			case <-returned:
@@ -123,45 +241,63 @@ func dualStackDialContext(ctx context.Context, network, address string, options
 				}
 			}
 		}()
-
-		var ip net.IP
-		if ipv6 {
-			ip, result.error = resolver.ResolveIPv6(host)
-		} else {
-			ip, result.error = resolver.ResolveIPv4(host)
-		}
-		if result.error != nil {
-			return
-		}
-		result.resolved = true
-
-		result.Conn, result.error = dialContext(ctx, network, ip, port, options)
 	}
 
-	go startRacer(ctx, network+"4", host, false)
-	go startRacer(ctx, network+"6", host, true)
+	startNext()
+	if raceFirst && next < len(ips) {
+		startNext()
+	}
 
-	for res := range results {
-		if res.error == nil {
-			return res.Conn, nil
+	timer := time.NewTimer(DefaultAttemptDelay)
+	defer timer.Stop()
+	resetTimer := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
 		}
+		timer.Reset(DefaultAttemptDelay)
+	}
 
-		if !res.ipv6 {
-			primary = res
-		} else {
-			fallback = res
-		}
+	var errs dialErrors
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.error == nil {
+				return res.Conn, nil
+			}
+			errs = append(errs, res.error)
+			// visible even if another address wins later
+			logrus.Debugf("[Dialer] dial %s failed: %s", net.JoinHostPort(res.ip.String(), port), res.error)
 
-		if primary.done && fallback.done {
-			if primary.resolved {
-				return nil, primary.error
-			} else if fallback.resolved {
-				return nil, fallback.error
-			} else {
-				return nil, primary.error
+			// the attempt failed, start the next one at once
+			if next < len(ips) {
+				startNext()
+				resetTimer()
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				startNext()
+				timer.Reset(DefaultAttemptDelay)
 			}
 		}
 	}
 
-	return nil, errors.New("never touched")
+	if len(errs) == 1 {
+		return nil, errs[0]
+	}
+	return nil, errs
+}
+
+// dialErrors is the errors of all addresses dialed
+type dialErrors []error
+
+func (e dialErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return "all addresses failed: " + strings.Join(msgs, "; ")
 }
@@ -1,11 +1,23 @@
 package dialer
 
-import "go.uber.org/atomic"
+import (
+	"go.uber.org/atomic"
+	"time"
+)
 
 var (
 	DefaultOptions     []Option
 	DefaultInterface   = atomic.NewString("")
 	DefaultRoutingMark = atomic.NewInt32(0)
+
+	// DefaultAttemptDelay is the delay before dialing the next address
+	// while the previous one is in progress (RFC 8305 section 5)
+	DefaultAttemptDelay = 250 * time.Millisecond
+	// DefaultAttemptTimeout is the timeout of dialing a single address
+	DefaultAttemptTimeout = 5 * time.Second
+	// DefaultResolutionDelay is how long to wait for the other ip version
+	// after one of them resolved (RFC 8305 section 3)
+	DefaultResolutionDelay = 50 * time.Millisecond
 )
 
 type option struct {
@@ -0,0 +1,59 @@
+package logs
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	FormatText   = "text"
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// NewFormatter return the formatter of text, json or logfmt
+func NewFormatter(format string) (logrus.Formatter, error) {
+	switch strings.ToLower(format) {
+	case "", FormatText:
+		return &ConsoleFormatter{}, nil
+	case FormatJSON:
+		return &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}, nil
+	case FormatLogfmt:
+		return &logrus.TextFormatter{
+			DisableColors:   true,
+			FullTimestamp:   true,
+			TimestampFormat: time.RFC3339Nano,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupport log format: %s", format)
+	}
+}
+
+type ConsoleFormatter struct {
+	logrus.TextFormatter
+}
+
+func (c *ConsoleFormatter) TrimFunctionSuffix(s string) string {
+	if strings.Contains(s, ".func") {
+		index := strings.Index(s, ".func")
+		s = s[:index]
+	}
+	return s
+}
+
+func (c *ConsoleFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	file := path.Base(entry.Caller.File)
+	function := c.TrimFunctionSuffix(path.Base(entry.Caller.Function))
+	logStr := fmt.Sprintf("%s %s %s:%d %s %v\n",
+		entry.Time.Format("2006/01/02 15:04:05"),
+		strings.ToUpper(entry.Level.String()),
+		file,
+		entry.Caller.Line,
+		function,
+		entry.Message,
+	)
+	return []byte(logStr), nil
+}
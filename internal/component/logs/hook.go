@@ -0,0 +1,96 @@
+package logs
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	// subscriberBuffer is the entries buffered for a subscriber,
+	// the subscriber is dropped once it is full
+	subscriberBuffer = 256
+	maxSubscribers   = 32
+)
+
+var ErrTooManySubscribers = errors.New("too many log subscribers")
+
+// DefaultHook fan out the log entries to the subscribers of /api/logs
+var DefaultHook = NewHook()
+
+// Event is a log entry sent to the subscribers
+type Event struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// Hook implements logrus.Hook, never block the logger
+type Hook struct {
+	mux sync.Mutex
+	// the channels and the levels they subscribed
+	subscribers map[chan *Event]logrus.Level
+}
+
+// Levels implements logrus.Hook
+func (h *Hook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook
+func (h *Hook) Fire(entry *logrus.Entry) error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if len(h.subscribers) == 0 {
+		return nil
+	}
+
+	event := &Event{
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Message: entry.Message,
+	}
+	for ch, level := range h.subscribers {
+		if entry.Level > level {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+			// the slow subscriber is dropped, the closed channel tells it
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+	return nil
+}
+
+// Subscribe return a channel receive the entries of the level and above,
+// the channel is closed if the subscriber can't keep up
+func (h *Hook) Subscribe(level logrus.Level) (chan *Event, error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if len(h.subscribers) >= maxSubscribers {
+		return nil, ErrTooManySubscribers
+	}
+	ch := make(chan *Event, subscriberBuffer)
+	h.subscribers[ch] = level
+	return ch, nil
+}
+
+// Unsubscribe stop the channel receive entries
+func (h *Hook) Unsubscribe(ch chan *Event) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if _, ok := h.subscribers[ch]; ok {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+func NewHook() *Hook {
+	return &Hook{
+		subscribers: map[chan *Event]logrus.Level{},
+	}
+}
@@ -0,0 +1,184 @@
+package logs
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	OutputStdout = "stdout"
+	OutputFile   = "file"
+	OutputSyslog = "syslog"
+)
+
+// Config is the format and the output of logrus
+type Config struct {
+	Format string
+	// stdout, file or syslog. the file if Filename is set when empty
+	Output string
+
+	Filename   string
+	MaxBackups int
+	MaxSize    int
+	MaxAge     int
+	Compress   bool
+
+	Syslog SyslogConfig
+}
+
+func (c Config) output() string {
+	if c.Output != "" {
+		return strings.ToLower(c.Output)
+	}
+	if c.Filename != "" && c.Filename != OutputStdout {
+		return OutputFile
+	}
+	return OutputStdout
+}
+
+// Validate return error if the format or output is invalid
+func (c Config) Validate() error {
+	if _, err := NewFormatter(c.Format); err != nil {
+		return err
+	}
+	switch c.output() {
+	case OutputStdout:
+	case OutputFile:
+		if c.Filename == "" {
+			return fmt.Errorf("log filename is empty")
+		}
+	case OutputSyslog:
+		return c.Syslog.validate()
+	default:
+		return fmt.Errorf("unsupport log output: %s", c.Output)
+	}
+	return nil
+}
+
+var (
+	outputMux sync.Mutex
+	current   *Config
+	closer    io.Closer
+)
+
+// Output is an opened output of logrus, not in use until installed
+type Output struct {
+	cfg       Config
+	formatter logrus.Formatter
+	out       io.Writer
+	closer    io.Closer
+}
+
+// Open validate the config and open the output, the logger in use is untouched
+func Open(cfg Config) (*Output, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	formatter, _ := NewFormatter(cfg.Format)
+
+	outputMux.Lock()
+	unchanged := current != nil && *current == cfg
+	outputMux.Unlock()
+	if unchanged {
+		return &Output{cfg: cfg}, nil
+	}
+
+	o := &Output{cfg: cfg, formatter: formatter}
+	switch cfg.output() {
+	case OutputFile:
+		if err := os.MkdirAll(filepath.Dir(cfg.Filename), 0777); err != nil {
+			return nil, err
+		}
+		file := &lumberjack.Logger{
+			Filename:   cfg.Filename,
+			MaxBackups: cfg.MaxBackups,
+			MaxSize:    cfg.MaxSize,
+			MaxAge:     cfg.MaxAge,
+			Compress:   cfg.Compress,
+			LocalTime:  true,
+		}
+		o.out, o.closer = file, file
+	case OutputSyslog:
+		w, f, err := newSyslog(cfg.Syslog, formatter)
+		if err != nil {
+			return nil, err
+		}
+		o.out, o.closer, o.formatter = w, w, f
+	default:
+		o.out = os.Stdout
+	}
+	return o, nil
+}
+
+// Install set the output to logrus and close the old one,
+// nothing changes if the config is in use already
+func (o *Output) Install() {
+	outputMux.Lock()
+	defer outputMux.Unlock()
+	if o.out == nil || current != nil && *current == o.cfg {
+		o.Close()
+		return
+	}
+
+	logrus.SetFormatter(o.formatter)
+	logrus.SetOutput(o.out)
+	closeOutput()
+	closer = o.closer
+	current = &o.cfg
+	o.closer = nil
+}
+
+// Close release the output not installed
+func (o *Output) Close() {
+	if o.closer == nil {
+		return
+	}
+	if err := o.closer.Close(); err != nil {
+		logrus.Warnln(err)
+	}
+	o.closer = nil
+}
+
+// Apply set the format and output of logrus, the output is reopened only if changed
+func Apply(cfg Config) error {
+	o, err := Open(cfg)
+	if err != nil {
+		return err
+	}
+	o.Install()
+	return nil
+}
+
+// Discard drop the logs and close the output
+func Discard() {
+	outputMux.Lock()
+	defer outputMux.Unlock()
+	logrus.SetOutput(io.Discard)
+	closeOutput()
+	current = nil
+}
+
+// Rotate start a new file if the output is file
+func Rotate() {
+	outputMux.Lock()
+	defer outputMux.Unlock()
+	if file, ok := closer.(*lumberjack.Logger); ok {
+		_ = file.Rotate()
+	}
+}
+
+func closeOutput() {
+	if closer == nil {
+		return
+	}
+	if err := closer.Close(); err != nil {
+		logrus.Warnln(err)
+	}
+	closer = nil
+}
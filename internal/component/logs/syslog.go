@@ -0,0 +1,263 @@
+package logs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	syslogTimeout = 5 * time.Second
+	// syslogQueueSize is the messages waiting to be sent, the later are dropped
+	syslogQueueSize = 1024
+)
+
+// the local syslog sockets, tried in order
+var localSyslogAddresses = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// SyslogConfig is the syslog server, the local socket if Network is empty or unix
+type SyslogConfig struct {
+	// unix, unixgram, udp or tcp
+	Network  string
+	Address  string
+	Tag      string
+	Facility string
+}
+
+func (c SyslogConfig) validate() error {
+	switch c.Network {
+	case "", "unix", "unixgram":
+	case "udp", "tcp":
+		if c.Address == "" {
+			return fmt.Errorf("syslog address of %s is empty", c.Network)
+		}
+		if _, _, err := net.SplitHostPort(c.Address); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupport syslog network: %s", c.Network)
+	}
+	if _, ok := facilities[strings.ToLower(c.Facility)]; c.Facility != "" && !ok {
+		return fmt.Errorf("unsupport syslog facility: %s", c.Facility)
+	}
+	return nil
+}
+
+// syslogFormatter frame the entry formatted by inner as a RFC 5424 message
+type syslogFormatter struct {
+	inner    logrus.Formatter
+	facility int
+	hostname string
+	tag      string
+	pid      int
+}
+
+func (f *syslogFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	msg, err := f.inner.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	_, _ = fmt.Fprintf(buf, "<%d>1 %s %s %s %d - - ",
+		f.facility*8+severity(entry.Level),
+		entry.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		f.hostname,
+		f.tag,
+		f.pid,
+	)
+	buf.Write(bytes.TrimRight(msg, "\n"))
+	return buf.Bytes(), nil
+}
+
+func severity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel:
+		return 0
+	case logrus.FatalLevel:
+		return 2
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
+
+// syslogWriter queue the messages and send them in background, never block the logger.
+// the messages are dropped if the queue is full or the server unreachable
+type syslogWriter struct {
+	network string
+	address string
+	conn    net.Conn
+	// lastDial is the time of last failed dial, redial at most once per syslogTimeout
+	lastDial time.Time
+
+	queue   chan []byte
+	dropped *atomic.Int64
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (w *syslogWriter) dial() (net.Conn, error) {
+	switch w.network {
+	case "udp", "tcp":
+		return net.DialTimeout(w.network, w.address, syslogTimeout)
+	}
+
+	addresses := localSyslogAddresses
+	if w.address != "" {
+		addresses = []string{w.address}
+	}
+	networks := []string{"unixgram", "unix"}
+	if w.network != "" {
+		networks = []string{w.network}
+	}
+	var err error
+	for _, address := range addresses {
+		for _, network := range networks {
+			var conn net.Conn
+			if conn, err = net.DialTimeout(network, address, syslogTimeout); err == nil {
+				return conn, nil
+			}
+		}
+	}
+	if err == nil {
+		err = errors.New("no local syslog")
+	}
+	return nil, err
+}
+
+// frame the message, octet counting for tcp (RFC 6587) and a newline for unix stream
+func (w *syslogWriter) frame(conn net.Conn, p []byte) []byte {
+	switch conn.LocalAddr().Network() {
+	case "tcp":
+		return append([]byte(fmt.Sprintf("%d ", len(p))), p...)
+	case "unix":
+		return append(append([]byte{}, p...), '\n')
+	default:
+		return p
+	}
+}
+
+// Write implements io.Writer, p is queued
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	select {
+	case <-w.done:
+		return 0, errors.New("syslog closed")
+	default:
+	}
+	select {
+	case w.queue <- append([]byte{}, p...):
+	default:
+		w.dropped.Inc()
+	}
+	return len(p), nil
+}
+
+func (w *syslogWriter) send(p []byte) error {
+	var err error
+	for i := 0; i < 2; i++ {
+		if w.conn == nil {
+			if time.Since(w.lastDial) < syslogTimeout {
+				return errors.New("syslog unreachable")
+			}
+			if w.conn, err = w.dial(); err != nil {
+				w.lastDial = time.Now()
+				return err
+			}
+		}
+		_ = w.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		if _, err = w.conn.Write(w.frame(w.conn, p)); err == nil {
+			return nil
+		}
+		_ = w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
+
+func (w *syslogWriter) loop() {
+	defer func() {
+		if w.conn != nil {
+			_ = w.conn.Close()
+		}
+	}()
+	for {
+		select {
+		case p := <-w.queue:
+			if err := w.send(p); err != nil {
+				w.dropped.Inc()
+			}
+			// the drops are reported once the server is back
+			if dropped := w.dropped.Load(); dropped != 0 && w.conn != nil {
+				w.dropped.Sub(dropped)
+				logrus.Warnf("[Syslog] %d messages dropped", dropped)
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Close stop the sender, the queued messages are discarded
+func (w *syslogWriter) Close() error {
+	w.once.Do(func() {
+		close(w.done)
+	})
+	return nil
+}
+
+func newSyslog(cfg SyslogConfig, inner logrus.Formatter) (*syslogWriter, logrus.Formatter, error) {
+	w := &syslogWriter{
+		network: cfg.Network,
+		address: cfg.Address,
+		queue:   make(chan []byte, syslogQueueSize),
+		dropped: atomic.NewInt64(0),
+		done:    make(chan struct{}),
+	}
+	// dial at once, an unreachable server is reported to the config update
+	conn, err := w.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn = conn
+	go w.loop()
+
+	facility := facilities["daemon"]
+	if cfg.Facility != "" {
+		facility = facilities[strings.ToLower(cfg.Facility)]
+	}
+	tag := cfg.Tag
+	if tag == "" {
+		tag = "mixed-socks"
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	return w, &syslogFormatter{
+		inner:    inner,
+		facility: facility,
+		hostname: hostname,
+		tag:      tag,
+		pid:      os.Getpid(),
+	}, nil
+}
@@ -0,0 +1,46 @@
+package metrics
+
+// the upper bounds in seconds of dial latency
+var dialBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	TrafficBytes = NewCounterVec("traffic_bytes_total",
+		"Bytes relayed by direction, inbound, outbound and user.",
+		"direction", "inbound", "outbound", "user")
+	Connections = NewCounterVec("connections_total",
+		"Connections accepted by network and inbound.",
+		"network", "inbound")
+	HandshakeFailures = NewCounterVec("handshake_failures_total",
+		"Inbound handshake failures by protocol and reason.",
+		"protocol", "reason")
+	AuthFailures = NewCounterVec("auth_failures_total",
+		"Authentication failures by protocol.",
+		"protocol")
+	DialDuration = NewHistogramVec("dial_duration_seconds",
+		"Latency of dialing the remote by network and result.",
+		dialBuckets, "network", "result")
+	DNSQueries = NewCounterVec("dns_queries_total",
+		"DNS queries answered by result and upstream.",
+		"result", "upstream")
+	DNSCache = NewCounterVec("dns_cache_requests_total",
+		"DNS cache lookups by result.",
+		"result")
+)
+
+func init() {
+	Register(TrafficBytes)
+	Register(Connections)
+	Register(HandshakeFailures)
+	Register(AuthFailures)
+	Register(DialDuration)
+	Register(DNSQueries)
+	Register(DNSCache)
+	Register(NewGaugeFunc("dns_cache_hit_ratio", "Ratio of DNS queries answered from cache.",
+		func(observe func(v float64, values ...string)) {
+			var ratio float64
+			if total := DNSCache.Sum(); total != 0 {
+				ratio = DNSCache.Sum("hit") / total
+			}
+			observe(ratio)
+		}))
+}
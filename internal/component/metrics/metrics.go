@@ -0,0 +1,320 @@
+package metrics
+
+import (
+	"bytes"
+	"go.uber.org/atomic"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const namespace = "mixed_socks"
+
+// DefaultRegistry hold the metrics exposed by the controller
+var DefaultRegistry = NewRegistry()
+
+type collector interface {
+	write(buf *bytes.Buffer)
+}
+
+// Registry write the registered metrics in Prometheus text format
+type Registry struct {
+	mux        sync.RWMutex
+	collectors []collector
+}
+
+func (r *Registry) Register(c collector) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteTo implements io.WriterTo
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mux.RLock()
+	collectors := append([]collector{}, r.collectors...)
+	r.mux.RUnlock()
+
+	buf := &bytes.Buffer{}
+	for _, c := range collectors {
+		c.write(buf)
+	}
+	return buf.WriteTo(w)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *desc) writeHeader(buf *bytes.Buffer, typ string) {
+	buf.WriteString("# HELP " + d.name + " " + d.help + "\n")
+	buf.WriteString("# TYPE " + d.name + " " + typ + "\n")
+}
+
+// writeSample write a line of sample, the extra label is appended after the labels of desc
+func (d *desc) writeSample(buf *bytes.Buffer, suffix string, values []string, extra string, value float64) {
+	buf.WriteString(d.name + suffix)
+	if len(values) != 0 || extra != "" {
+		buf.WriteByte('{')
+		for i, v := range values {
+			if i != 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(d.labels[i] + `="` + escapeLabel(v) + `"`)
+		}
+		if extra != "" {
+			if len(values) != 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(extra)
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(formatFloat(value))
+	buf.WriteByte('\n')
+}
+
+// labelValues pad or cut the values to the count of labels
+func (d *desc) labelValues(values []string) []string {
+	ret := make([]string, len(d.labels))
+	copy(ret, values)
+	return ret
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	value *atomic.Float64
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	c.value.Add(v)
+}
+
+type counterSeries struct {
+	values  []string
+	counter *Counter
+}
+
+// CounterVec is the counters partitioned by the label values
+type CounterVec struct {
+	desc
+	mux    sync.RWMutex
+	series map[string]*counterSeries
+}
+
+// With return the counter of the label values, created if not exist
+func (c *CounterVec) With(values ...string) *Counter {
+	values = c.labelValues(values)
+	key := strings.Join(values, "\xff")
+
+	c.mux.RLock()
+	s, ok := c.series[key]
+	c.mux.RUnlock()
+	if ok {
+		return s.counter
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if s, ok = c.series[key]; !ok {
+		s = &counterSeries{values: values, counter: &Counter{value: atomic.NewFloat64(0)}}
+		c.series[key] = s
+	}
+	return s.counter
+}
+
+// Sum return the sum of the counters match the label values, empty value match all
+func (c *CounterVec) Sum(values ...string) float64 {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	var sum float64
+	for _, s := range c.series {
+		if matchValues(s.values, values) {
+			sum += s.counter.value.Load()
+		}
+	}
+	return sum
+}
+
+func (c *CounterVec) write(buf *bytes.Buffer) {
+	c.writeHeader(buf, "counter")
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		c.writeSample(buf, "", s.values, "", s.counter.value.Load())
+	}
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		desc:   desc{name: namespace + "_" + name, help: help, labels: labels},
+		series: map[string]*counterSeries{},
+	}
+}
+
+// Histogram count the observed values in buckets
+type Histogram struct {
+	upperBounds []float64
+	counts      []*atomic.Uint64
+	count       *atomic.Uint64
+	sum         *atomic.Float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	idx := sort.SearchFloat64s(h.upperBounds, v)
+	if idx < len(h.counts) {
+		h.counts[idx].Inc()
+	}
+	h.count.Inc()
+	h.sum.Add(v)
+}
+
+type histogramSeries struct {
+	values    []string
+	histogram *Histogram
+}
+
+// HistogramVec is the histograms partitioned by the label values
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mux     sync.RWMutex
+	series  map[string]*histogramSeries
+}
+
+// With return the histogram of the label values, created if not exist
+func (h *HistogramVec) With(values ...string) *Histogram {
+	values = h.labelValues(values)
+	key := strings.Join(values, "\xff")
+
+	h.mux.RLock()
+	s, ok := h.series[key]
+	h.mux.RUnlock()
+	if ok {
+		return s.histogram
+	}
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if s, ok = h.series[key]; !ok {
+		histogram := &Histogram{
+			upperBounds: h.buckets,
+			counts:      make([]*atomic.Uint64, len(h.buckets)),
+			count:       atomic.NewUint64(0),
+			sum:         atomic.NewFloat64(0),
+		}
+		for i := range histogram.counts {
+			histogram.counts[i] = atomic.NewUint64(0)
+		}
+		s = &histogramSeries{values: values, histogram: histogram}
+		h.series[key] = s
+	}
+	return s.histogram
+}
+
+func (h *HistogramVec) write(buf *bytes.Buffer) {
+	h.writeHeader(buf, "histogram")
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		// the buckets are cumulative
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.histogram.counts[i].Load()
+			h.writeSample(buf, "_bucket", s.values, `le="`+formatFloat(bound)+`"`, float64(cumulative))
+		}
+		count := s.histogram.count.Load()
+		h.writeSample(buf, "_bucket", s.values, `le="+Inf"`, float64(count))
+		h.writeSample(buf, "_sum", s.values, "", s.histogram.sum.Load())
+		h.writeSample(buf, "_count", s.values, "", float64(count))
+	}
+}
+
+// NewHistogramVec create the histograms with the upper bounds of buckets in increasing order
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		desc:    desc{name: namespace + "_" + name, help: help, labels: labels},
+		buckets: buckets,
+		series:  map[string]*histogramSeries{},
+	}
+}
+
+// GaugeFunc collect the gauge values when scraped, the observe callback
+// is called for every label values
+type GaugeFunc struct {
+	desc
+	collect func(observe func(v float64, values ...string))
+}
+
+func (g *GaugeFunc) write(buf *bytes.Buffer) {
+	g.writeHeader(buf, "gauge")
+	g.collect(func(v float64, values ...string) {
+		g.writeSample(buf, "", g.labelValues(values), "", v)
+	})
+}
+
+func NewGaugeFunc(name, help string, collect func(observe func(v float64, values ...string)), labels ...string) *GaugeFunc {
+	return &GaugeFunc{
+		desc:    desc{name: namespace + "_" + name, help: help, labels: labels},
+		collect: collect,
+	}
+}
+
+// Register add the collector to DefaultRegistry
+func Register(c collector) {
+	DefaultRegistry.Register(c)
+}
+
+func matchValues(values, filter []string) bool {
+	for i, v := range filter {
+		if v != "" && i < len(values) && values[i] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
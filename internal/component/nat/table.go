@@ -30,6 +30,26 @@ func (t *Table) Delete(key string) {
 	t.mapping.Delete(key)
 }
 
+// DeleteIf delete the mapping only if it is still pc,
+// keep the newer session of the same key
+func (t *Table) DeleteIf(key string, pc constant.PacketConn) {
+	if item, exist := t.mapping.Load(key); exist && item == pc {
+		t.mapping.Delete(key)
+	}
+}
+
+// Len return the count of the mappings, the locks are not counted
+func (t *Table) Len() int {
+	n := 0
+	t.mapping.Range(func(key, value any) bool {
+		if _, ok := value.(constant.PacketConn); ok {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
 // New return *Cache
 func New() *Table {
 	return &Table{}
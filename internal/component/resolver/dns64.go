@@ -0,0 +1,71 @@
+package resolver
+
+import (
+	"net"
+)
+
+// DefaultNAT64Prefix is the prefix of the ipv6 addresses synthesized by DNS64,
+// nil means DNS64 disabled
+var DefaultNAT64Prefix *net.IPNet
+
+// WellKnownNAT64Prefix is the well-known prefix of RFC 6052
+var WellKnownNAT64Prefix = &net.IPNet{
+	IP:   net.ParseIP("64:ff9b::"),
+	Mask: net.CIDRMask(96, 128),
+}
+
+// ValidNAT64Prefix return whether the prefix length is one of 32, 40, 48, 56, 64 and 96
+func ValidNAT64Prefix(prefix *net.IPNet) bool {
+	ones, bits := prefix.Mask.Size()
+	if bits != 128 {
+		return false
+	}
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+		return true
+	default:
+		return false
+	}
+}
+
+// SynthesizeIPv6 embed the ipv4 into the prefix (RFC 6052 section 2.2),
+// the bits 64 to 71 are skipped
+func SynthesizeIPv6(prefix *net.IPNet, v4 net.IP) net.IP {
+	v4 = v4.To4()
+	if v4 == nil {
+		return nil
+	}
+	ones, _ := prefix.Mask.Size()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16()[:ones/8])
+
+	pos := ones / 8
+	for _, b := range v4 {
+		if pos == 8 {
+			pos++
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
+
+// ExtractIPv4 return the ipv4 embedded in the ip, nil if the ip is not in the prefix
+func ExtractIPv4(prefix *net.IPNet, ip net.IP) net.IP {
+	if prefix == nil || ip.To4() != nil || !prefix.Contains(ip) {
+		return nil
+	}
+	ip = ip.To16()
+	ones, _ := prefix.Mask.Size()
+
+	v4 := make(net.IP, net.IPv4len)
+	pos := ones / 8
+	for i := range v4 {
+		if pos == 8 {
+			pos++
+		}
+		v4[i] = ip[pos]
+		pos++
+	}
+	return v4
+}
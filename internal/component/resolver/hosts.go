@@ -0,0 +1,88 @@
+package resolver
+
+import (
+	"net"
+	"strings"
+)
+
+// MaxHostsCNAMEChain limit the CNAME chain in hosts, avoid the loop
+const MaxHostsCNAMEChain = 8
+
+// MX is a mail exchange record of hosts
+type MX struct {
+	Preference uint16
+	Host       string
+}
+
+// SRV is a service record of hosts
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+// HostRecord is the local records of a name in hosts
+type HostRecord struct {
+	IPs   []net.IP
+	CNAME string
+	TXT   []string
+	MX    []MX
+	SRV   []SRV
+	PTR   []string
+}
+
+// IPv4 return the ipv4 addresses of record
+func (r *HostRecord) IPv4() []net.IP {
+	return filterIPv4(r.IPs)
+}
+
+// IPv6 return the ipv6 addresses of record
+func (r *HostRecord) IPv6() []net.IP {
+	return filterIPv6(r.IPs)
+}
+
+// SearchHosts return the record of host in DefaultHosts, nil if not found
+func SearchHosts(host string) *HostRecord {
+	node := DefaultHosts.Search(strings.TrimRight(host, "."))
+	if node == nil {
+		return nil
+	}
+	return node.Data.(*HostRecord)
+}
+
+// LookupHosts follow the CNAME chain of host in DefaultHosts,
+// return the ips if found, and the last name of chain should be resolved otherwise
+func LookupHosts(host string) ([]net.IP, string) {
+	for i := 0; i < MaxHostsCNAMEChain; i++ {
+		record := SearchHosts(host)
+		if record == nil {
+			return nil, host
+		}
+		if record.CNAME == "" {
+			return record.IPs, host
+		}
+		host = strings.TrimRight(record.CNAME, ".")
+	}
+	return nil, host
+}
+
+func filterIPv4(ips []net.IP) []net.IP {
+	var ret []net.IP
+	for _, ip := range ips {
+		if v4 := ip.To4(); v4 != nil {
+			ret = append(ret, v4)
+		}
+	}
+	return ret
+}
+
+func filterIPv6(ips []net.IP) []net.IP {
+	var ret []net.IP
+	for _, ip := range ips {
+		if ip.To4() == nil {
+			ret = append(ret, ip)
+		}
+	}
+	return ret
+}
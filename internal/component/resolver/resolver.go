@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/xmapst/mixed-socks/internal/component/trie"
+	"go.uber.org/atomic"
 	"math/rand"
 	"net"
 	"strings"
@@ -15,23 +16,90 @@ var (
 	// DefaultResolver aim to resolve ip
 	DefaultResolver Resolver
 
-	// DisableIPv6 means don't resolve ipv6 host
-	// default value is true
-	DisableIPv6 = true
-
-	// DefaultHosts aim to resolve hosts
+	// DefaultHosts aim to resolve hosts, the data of node is *HostRecord
 	DefaultHosts = trie.New()
 
 	// DefaultDNSTimeout defined the default dns request timeout
 	DefaultDNSTimeout = time.Second * 5
 )
 
+// ipPreference decide which ip version to resolve and dial, updated on reload.
+// default value is IPv4Only, means don't resolve ipv6 host
+var ipPreference = atomic.NewInt32(int32(IPv4Only))
+
+// GetIPPreference return the ip version preference in use
+func GetIPPreference() IPPreference {
+	return IPPreference(ipPreference.Load())
+}
+
+// SetIPPreference replace the ip version preference
+func SetIPPreference(p IPPreference) {
+	ipPreference.Store(int32(p))
+}
+
 var (
 	ErrIPNotFound   = errors.New("couldn't find ip")
 	ErrIPVersion    = errors.New("ip version error")
 	ErrIPv6Disabled = errors.New("ipv6 disabled")
+	ErrIPv4Disabled = errors.New("ipv4 disabled")
 )
 
+// IPPreference is enum of ip version preference
+type IPPreference int
+
+const (
+	IPv4Only IPPreference = iota
+	IPv6Only
+	PreferIPv4
+	PreferIPv6
+	DualStack
+)
+
+func (p IPPreference) String() string {
+	switch p {
+	case IPv4Only:
+		return "ipv4-only"
+	case IPv6Only:
+		return "ipv6-only"
+	case PreferIPv4:
+		return "prefer-ipv4"
+	case PreferIPv6:
+		return "prefer-ipv6"
+	case DualStack:
+		return "dual"
+	default:
+		return "unknown"
+	}
+}
+
+// IPv4Enabled return whether ipv4 host should be resolved
+func (p IPPreference) IPv4Enabled() bool {
+	return p != IPv6Only
+}
+
+// IPv6Enabled return whether ipv6 host should be resolved
+func (p IPPreference) IPv6Enabled() bool {
+	return p != IPv4Only
+}
+
+// ParseIPPreference parse ip preference from string
+func ParseIPPreference(s string) (IPPreference, error) {
+	switch strings.ToLower(s) {
+	case "ipv4-only":
+		return IPv4Only, nil
+	case "ipv6-only":
+		return IPv6Only, nil
+	case "", "prefer-ipv4":
+		return PreferIPv4, nil
+	case "prefer-ipv6":
+		return PreferIPv6, nil
+	case "dual":
+		return DualStack, nil
+	default:
+		return IPv4Only, fmt.Errorf("unsupport ip preference: %s", s)
+	}
+}
+
 type Resolver interface {
 	LookupIP(ctx context.Context, host string) ([]net.IP, error)
 	LookupIPv4(ctx context.Context, host string) ([]net.IP, error)
@@ -43,10 +111,13 @@ type Resolver interface {
 
 // LookupIPv4 with a host, return ipv4 list
 func LookupIPv4(ctx context.Context, host string) ([]net.IP, error) {
-	if node := DefaultHosts.Search(host); node != nil {
-		if ip := node.Data.(net.IP).To4(); ip != nil {
-			return []net.IP{ip}, nil
-		}
+	if !GetIPPreference().IPv4Enabled() {
+		return nil, ErrIPv4Disabled
+	}
+
+	ips, host := LookupHosts(host)
+	if ips := filterIPv4(ips); len(ips) != 0 {
+		return ips, nil
 	}
 
 	ip := net.ParseIP(host)
@@ -86,14 +157,13 @@ func ResolveIPv4(host string) (net.IP, error) {
 
 // LookupIPv6 with a host, return ipv6 list
 func LookupIPv6(ctx context.Context, host string) ([]net.IP, error) {
-	if DisableIPv6 {
+	if !GetIPPreference().IPv6Enabled() {
 		return nil, ErrIPv6Disabled
 	}
 
-	if node := DefaultHosts.Search(host); node != nil {
-		if ip := node.Data.(net.IP).To16(); ip != nil {
-			return []net.IP{ip}, nil
-		}
+	ips, host := LookupHosts(host)
+	if ips := filterIPv6(ips); len(ips) != 0 {
+		return ips, nil
 	}
 
 	ip := net.ParseIP(host)
@@ -133,17 +203,13 @@ func ResolveIPv6(host string) (net.IP, error) {
 
 // LookupIPWithResolver same as ResolveIP, but with a resolver
 func LookupIPWithResolver(ctx context.Context, host string, r Resolver) ([]net.IP, error) {
-	if node := DefaultHosts.Search(host); node != nil {
-		return []net.IP{node.Data.(net.IP)}, nil
+	ips, host := LookupHosts(host)
+	if len(ips) != 0 {
+		return ips, nil
 	}
 
 	if r != nil {
-		if DisableIPv6 {
-			return r.LookupIPv4(ctx, host)
-		}
 		return r.LookupIP(ctx, host)
-	} else if DisableIPv6 {
-		return LookupIPv4(ctx, host)
 	}
 
 	ip := net.ParseIP(host)
@@ -151,14 +217,61 @@ func LookupIPWithResolver(ctx context.Context, host string, r Resolver) ([]net.I
 		return []net.IP{ip}, nil
 	}
 
-	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
-	if err != nil {
-		return nil, err
-	} else if len(ips) == 0 {
-		return nil, ErrIPNotFound
+	return LookupIPByPreference(ctx, host, LookupIPv4, LookupIPv6)
+}
+
+// LookupIPByPreference lookup ipv4 and ipv6 with lookup functions according to the ip preference.
+// prefer modes return the preferred version, and fall back to the other one;
+// dual mode return both of them, ipv4 first.
+func LookupIPByPreference(ctx context.Context, host string, lookupIPv4, lookupIPv6 func(context.Context, string) ([]net.IP, error)) ([]net.IP, error) {
+	preference := GetIPPreference()
+	switch preference {
+	case IPv4Only:
+		return lookupIPv4(ctx, host)
+	case IPv6Only:
+		return lookupIPv6(ctx, host)
 	}
 
-	return ips, nil
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type lookupResult struct {
+		ips []net.IP
+		err error
+	}
+	v4Ch := make(chan lookupResult, 1)
+	v6Ch := make(chan lookupResult, 1)
+	go func() {
+		ips, err := lookupIPv4(ctx, host)
+		v4Ch <- lookupResult{ips, err}
+	}()
+	go func() {
+		ips, err := lookupIPv6(ctx, host)
+		v6Ch <- lookupResult{ips, err}
+	}()
+
+	primary, fallback := v4Ch, v6Ch
+	if preference == PreferIPv6 {
+		primary, fallback = v6Ch, v4Ch
+	}
+
+	first := <-primary
+	if preference != DualStack && first.err == nil && len(first.ips) != 0 {
+		return first.ips, nil
+	}
+
+	second := <-fallback
+	ips := append(first.ips, second.ips...)
+	if len(ips) != 0 {
+		return ips, nil
+	}
+	if first.err != nil {
+		return nil, first.err
+	}
+	if second.err != nil {
+		return nil, second.err
+	}
+	return nil, ErrIPNotFound
 }
 
 // ResolveIP with a host, return ip
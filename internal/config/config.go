@@ -1,20 +1,30 @@
 package config
 
 import (
+	"bufio"
+	"crypto/sha256"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
+	D "github.com/miekg/dns"
 	"github.com/robfig/cron/v3"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/xmapst/mixed-socks/internal/adapter"
+	"github.com/xmapst/mixed-socks/internal/adapter/outbound"
+	"github.com/xmapst/mixed-socks/internal/component/accesslog"
 	"github.com/xmapst/mixed-socks/internal/component/auth"
 	"github.com/xmapst/mixed-socks/internal/component/iface"
+	"github.com/xmapst/mixed-socks/internal/component/logs"
+	"github.com/xmapst/mixed-socks/internal/component/resolver"
 	"github.com/xmapst/mixed-socks/internal/component/trie"
 	"github.com/xmapst/mixed-socks/internal/constant"
 	"github.com/xmapst/mixed-socks/internal/dns"
-	"gopkg.in/natefinch/lumberjack.v2"
+	"github.com/xmapst/mixed-socks/internal/tunnel"
 	"net"
 	"net/url"
+	"os"
 	"strings"
+	"time"
 )
 
 var (
@@ -25,12 +35,16 @@ var (
 type Config struct {
 	Inbound    *Inbound
 	Outbound   *Outbound
+	Proxies    map[string]constant.Proxy
 	Controller *Controller
 	DNS        *DNS
 	Hosts      *trie.DomainTrie
 	Users      []auth.AuthUser
 	Whitelist  []net.IP
 	Log        *Log
+
+	IPv6         bool
+	IPPreference resolver.IPPreference
 }
 
 // Inbound config
@@ -40,8 +54,22 @@ type Inbound struct {
 }
 
 type Outbound struct {
-	Interface   string `yaml:""`
-	RoutingMark int    `yaml:""`
+	Interface   string   `yaml:""`
+	RoutingMark int      `yaml:""`
+	Proxies     []*Proxy `yaml:""`
+}
+
+// Proxy is an upstream socks5/http proxy, which can be referenced by name
+type Proxy struct {
+	Name           string `yaml:""`
+	Type           string `yaml:""`
+	Server         string `yaml:""`
+	Port           int    `yaml:""`
+	Username       string `yaml:""`
+	Password       string `yaml:""`
+	Interface      string `yaml:""`
+	TLS            bool   `yaml:""`
+	SkipCertVerify bool   `yaml:""`
 }
 
 type RawConfig struct {
@@ -49,10 +77,14 @@ type RawConfig struct {
 	Outbound   *Outbound         `yaml:""`
 	Controller *Controller       `yaml:""`
 	Auth       map[string]string `yaml:""`
-	Hosts      map[string]string `yaml:""`
+	Hosts      map[string]any    `yaml:""`
+	HostsFiles []string          `yaml:""`
 	DNS        RawDNS            `yaml:""`
 	Log        *Log              `yaml:""`
 	WhiteList  []string          `yaml:""`
+
+	IPv6         bool   `yaml:",default=false"`
+	IPPreference string `yaml:",default=prefer-ipv4"`
 }
 
 type Controller struct {
@@ -63,28 +95,184 @@ type Controller struct {
 }
 
 type RawDNS struct {
-	Enable      bool     `yaml:",default=true"`
-	NameServers []string `yaml:",default=8.8.8.8"`
-	Listen      string   `yaml:",default=0.0.0.0"`
-	Port        int      `yaml:",default=53"`
+	Enable       bool          `yaml:",default=true"`
+	NameServers  []string      `yaml:",default=8.8.8.8"`
+	Strategy     string        `yaml:",default=parallel-all"`
+	FastestN     int           `yaml:",default=2"`
+	Listen       string        `yaml:",default=0.0.0.0"`
+	Port         int           `yaml:",default=53"`
+	QueryLogSize int           `yaml:",default=1000"`
+	PersistCache bool          `yaml:",default=true"`
+	Blocklist    *RawBlocklist `yaml:""`
+	Cache        *RawDNSCache  `yaml:""`
+	DNSSEC       *RawDNSSEC    `yaml:""`
+	ACL          *RawDNSACL    `yaml:""`
+	Local        *RawDNSLocal  `yaml:""`
+	DNS64        *RawDNS64     `yaml:""`
+	Hijack       []string      `yaml:""`
+}
+
+type RawDNS64 struct {
+	Enable bool `yaml:",default=false"`
+	// NAT64 prefix, the length is one of 32, 40, 48, 56, 64 and 96
+	Prefix string `yaml:",default=64:ff9b::/96"`
+}
+
+type RawDNSLocal struct {
+	// LAN resolvers, dhcp://en0 discovers it by DHCP
+	NameServers []string `yaml:""`
+	// forwarded to the LAN resolvers, and single-label names too
+	SearchDomains []string `yaml:""`
+	// forward the PTR of private ranges to the LAN resolvers,
+	// answer NXDOMAIN if unresolvable
+	PrivateReverse bool `yaml:",default=true"`
+}
+
+type RawDNSACL struct {
+	// allowed client subnets, the WhiteList is used if empty
+	Allow []string `yaml:""`
+	// queries per second of a client, zero means unlimited
+	RateLimit float64 `yaml:",default=0"`
+	Burst     int     `yaml:",default=0"`
+	// answer every Slip-th limited query with TC bit, zero means drop all
+	Slip      int  `yaml:",default=2"`
+	RefuseAny bool `yaml:",default=true"`
+}
+
+type RawDNSSEC struct {
+	Enable bool `yaml:",default=false"`
+	// DS or DNSKEY records, the root KSK if empty
+	TrustAnchors []string `yaml:""`
+	// domains not to validate, e.g. the broken internal zones
+	NegativeTrustAnchors []string `yaml:""`
+}
+
+type RawDNSCache struct {
+	// clamp the ttl of answers in seconds, zero means no clamp
+	MinTTL uint32 `yaml:",default=0"`
+	MaxTTL uint32 `yaml:",default=86400"`
+	// how long expired answers can be served in seconds, zero means disabled
+	ServeStale int    `yaml:",default=86400"`
+	StaleTTL   uint32 `yaml:",default=30"`
+	// refresh popular answers before expiry
+	Prefetch     bool  `yaml:",default=true"`
+	PrefetchHits int64 `yaml:",default=3"`
+	// cache NXDOMAIN/NODATA with the SOA minimum
+	NegativeCache bool `yaml:",default=true"`
+}
+
+type RawBlocklist struct {
+	Enable bool `yaml:",default=false"`
+	// nxdomain / null / refused
+	Mode string `yaml:",default=nxdomain"`
+	// refresh interval of remote lists in seconds
+	Interval int                   `yaml:",default=86400"`
+	Lists    []dns.BlockListConfig `yaml:""`
+	Allow    []string              `yaml:""`
 }
 
 type DNS struct {
-	Enable      bool             `yaml:""`
-	NameServers []dns.NameServer `yaml:""`
-	Listen      string           `yaml:""`
-	Port        int              `yaml:""`
-	Hosts       *trie.DomainTrie
+	Enable       bool             `yaml:""`
+	NameServers  []dns.NameServer `yaml:""`
+	Strategy     string           `yaml:""`
+	FastestN     int              `yaml:""`
+	Listen       string           `yaml:""`
+	Port         int              `yaml:""`
+	QueryLogSize int              `yaml:""`
+	PersistCache bool             `yaml:""`
+	Hosts        *trie.DomainTrie
+	Blocker      *dns.BlockerConfig
+	Cache        dns.CacheConfig
+	DNSSEC       *dns.DNSSECConfig
+	ACL          *dns.ACLConfig
+	Local        *dns.LocalConfig
+	DNS64        *net.IPNet
+	Hijack       []tunnel.HijackRule
 }
 
 type Log struct {
-	Output     *lumberjack.Logger `json:"-" yaml:"-"`
-	Filename   string             `yaml:""`
-	Level      string             `yaml:",default=info"`
-	MaxBackups int                `yaml:",default=7"`
-	MaxSize    int                `yaml:",default=500"`
-	MaxAge     int                `yaml:",default=28"`
-	Compress   bool               `yaml:",default=true"`
+	// text, json or logfmt
+	Format string `yaml:",default=text"`
+	// stdout, file or syslog, the file if Filename is set when empty
+	Output     string     `yaml:""`
+	Filename   string     `yaml:""`
+	Level      string     `yaml:",default=info"`
+	MaxBackups int        `yaml:",default=7"`
+	MaxSize    int        `yaml:",default=500"`
+	MaxAge     int        `yaml:",default=28"`
+	Compress   bool       `yaml:",default=true"`
+	Syslog     *LogSyslog `yaml:""`
+	Access     *AccessLog `yaml:""`
+}
+
+// LogSyslog is the syslog server of the syslog output, the local syslog if Network is empty
+type LogSyslog struct {
+	// unix, unixgram, udp or tcp
+	Network  string `yaml:""`
+	Address  string `yaml:""`
+	Tag      string `yaml:",default=mixed-socks"`
+	Facility string `yaml:",default=daemon"`
+}
+
+// Config return the format and output of logger
+func (l *Log) Config() logs.Config {
+	cfg := logs.Config{
+		Format:     l.Format,
+		Output:     l.Output,
+		Filename:   l.Filename,
+		MaxBackups: l.MaxBackups,
+		MaxSize:    l.MaxSize,
+		MaxAge:     l.MaxAge,
+		Compress:   l.Compress,
+	}
+	if l.Syslog != nil {
+		cfg.Syslog = logs.SyslogConfig{
+			Network:  l.Syslog.Network,
+			Address:  l.Syslog.Address,
+			Tag:      l.Syslog.Tag,
+			Facility: l.Syslog.Facility,
+		}
+	}
+	return cfg
+}
+
+// AccessLog is a record per finished session, written to its own file
+type AccessLog struct {
+	Filename string `yaml:""`
+	// json or template
+	Format string `yaml:",default=json"`
+	// Template is the text/template of accesslog.Record, for the template format
+	Template   string `yaml:""`
+	MaxBackups int    `yaml:",default=7"`
+	MaxSize    int    `yaml:",default=500"`
+	MaxAge     int    `yaml:",default=28"`
+	Compress   bool   `yaml:""`
+}
+
+// Config return the config of access log, disabled if nil
+func (a *AccessLog) Config() accesslog.Config {
+	if a == nil {
+		return accesslog.Config{}
+	}
+	cfg := accesslog.Config{
+		Filename:   a.Filename,
+		Format:     a.Format,
+		Template:   a.Template,
+		MaxBackups: a.MaxBackups,
+		MaxSize:    a.MaxSize,
+		MaxAge:     a.MaxAge,
+		Compress:   a.Compress,
+	}
+	if cfg.MaxBackups == 0 {
+		cfg.MaxBackups = 7
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = 500
+	}
+	if cfg.MaxAge == 0 {
+		cfg.MaxAge = 28
+	}
+	return cfg
 }
 
 func viperLoadConf() (*RawConfig, error) {
@@ -92,6 +280,11 @@ func viperLoadConf() (*RawConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	return unmarshalRawConfig(v)
+}
+
+// unmarshalRawConfig decode the settings of viper with the defaults
+func unmarshalRawConfig(vp *viper.Viper) (*RawConfig, error) {
 	var conf = &RawConfig{
 		Inbound: &Inbound{
 			Listen: "0.0.0.0",
@@ -101,15 +294,35 @@ func viperLoadConf() (*RawConfig, error) {
 		Controller: &Controller{
 			Enable: false,
 		},
-		Hosts: map[string]string{},
+		Hosts: map[string]any{},
 		DNS: RawDNS{
 			Enable: false,
 			NameServers: []string{
 				"114.114.114.114",
 				"8.8.8.8",
 			},
+			Strategy:     dns.StrategyParallelAll,
+			FastestN:     2,
+			QueryLogSize: 1000,
+			PersistCache: true,
+			ACL: &RawDNSACL{
+				Slip:      2,
+				RefuseAny: true,
+			},
+			Local: &RawDNSLocal{
+				PrivateReverse: true,
+			},
+			Cache: &RawDNSCache{
+				MaxTTL:        86400,
+				ServeStale:    86400,
+				StaleTTL:      30,
+				Prefetch:      true,
+				PrefetchHits:  3,
+				NegativeCache: true,
+			},
 		},
 		Log: &Log{
+			Format:     logs.FormatText,
 			Level:      "info",
 			MaxBackups: 7,
 			MaxSize:    500,
@@ -117,14 +330,15 @@ func viperLoadConf() (*RawConfig, error) {
 			Compress:   true,
 		},
 	}
-	err = v.Unmarshal(conf)
+	err := vp.Unmarshal(conf)
 	if err != nil {
 		return nil, err
 	}
 	return conf, nil
 }
 
-func Load(changeCh chan bool) error {
+func Load(ch chan bool) error {
+	changeCh = ch
 	v.SetConfigFile(constant.Path.Config())
 	v.SetConfigType("yaml")
 	conf, err := viperLoadConf()
@@ -136,6 +350,12 @@ func Load(changeCh chan bool) error {
 		if !e.Has(fsnotify.Write) {
 			return
 		}
+		updateMux.Lock()
+		defer updateMux.Unlock()
+		// persisted by Update, already applied
+		if data, err := os.ReadFile(e.Name); err == nil && sha256.Sum256(data) == written {
+			return
+		}
 		logrus.Infoln(e.Name, "config file modified")
 		conf, err = viperLoadConf()
 		if err != nil {
@@ -147,67 +367,331 @@ func Load(changeCh chan bool) error {
 			logrus.Errorln(err)
 			return
 		}
+		settings = v.AllSettings()
 		changeCh <- true
 	})
 	err = conf.Parse()
 	if err != nil {
 		return err
 	}
+	settings = v.AllSettings()
 	c := cron.New()
 	_, _ = c.AddFunc("@daily", func() {
-		if App.Log.Output != nil {
-			_ = App.Log.Output.Rotate()
-		}
+		logs.Rotate()
+		accesslog.Default.Rotate()
 	})
 	c.Start()
 	changeCh <- true
 	return nil
 }
 
+// Parse validate the raw config, and replace App if valid
 func (c *RawConfig) Parse() error {
-	App = &Config{
+	cfg, err := c.parse()
+	if err != nil {
+		return err
+	}
+	App = cfg
+	return nil
+}
+
+func (c *RawConfig) parse() (*Config, error) {
+	cfg := &Config{
 		Inbound:    c.Inbound,
 		Outbound:   c.Outbound,
 		Log:        c.Log,
 		Controller: c.Controller,
 	}
+	preference, err := parseIPPreference(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Log != nil {
+		if err = c.Log.Config().Validate(); err != nil {
+			return nil, err
+		}
+		if err = c.Log.Access.Config().Validate(); err != nil {
+			return nil, err
+		}
+	}
+	cfg.IPv6 = c.IPv6
+	cfg.IPPreference = preference
+
+	proxies, err := parseProxies(c.Outbound)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Proxies = proxies
+
 	hosts, err := parseHosts(c)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	App.Hosts = hosts
+	cfg.Hosts = hosts
 
-	dnsCfg, err := parseDNS(c, hosts)
+	dnsCfg, err := parseDNS(c, hosts, proxies)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	App.DNS = dnsCfg
-	App.Users = parseAuthentication(c.Auth)
-	App.Whitelist = parseWhitelist(c.WhiteList)
-	return nil
+	cfg.DNS = dnsCfg
+	cfg.Users = parseAuthentication(c.Auth)
+	cfg.Whitelist = parseWhitelist(c.WhiteList)
+	return cfg, nil
+}
+
+func parseIPPreference(cfg *RawConfig) (resolver.IPPreference, error) {
+	preference, err := resolver.ParseIPPreference(cfg.IPPreference)
+	if err != nil {
+		return resolver.IPv4Only, err
+	}
+	// ipv6 switch off means ipv4 only whatever the preference is
+	if !cfg.IPv6 {
+		return resolver.IPv4Only, nil
+	}
+	return preference, nil
+}
+
+func parseProxies(cfg *Outbound) (map[string]constant.Proxy, error) {
+	proxies := make(map[string]constant.Proxy)
+	if cfg == nil {
+		return proxies, nil
+	}
+
+	for idx, p := range cfg.Proxies {
+		if p.Name == "" {
+			return nil, fmt.Errorf("Proxy[%d] missing name", idx)
+		}
+		if _, exist := proxies[p.Name]; exist || p.Name == "DIRECT" {
+			return nil, fmt.Errorf("Proxy %s is the duplicate name", p.Name)
+		}
+		if p.Server == "" || p.Port == 0 {
+			return nil, fmt.Errorf("Proxy %s missing server or port", p.Name)
+		}
+
+		var proxyAdapter constant.ProxyAdapter
+		switch strings.ToLower(p.Type) {
+		case "socks5":
+			proxyAdapter = outbound.NewSocks5(outbound.Socks5Option{
+				BasicOption:    outbound.BasicOption{Interface: p.Interface},
+				Name:           p.Name,
+				Server:         p.Server,
+				Port:           p.Port,
+				UserName:       p.Username,
+				Password:       p.Password,
+				TLS:            p.TLS,
+				SkipCertVerify: p.SkipCertVerify,
+			})
+		case "http":
+			proxyAdapter = outbound.NewHttp(outbound.HttpOption{
+				BasicOption:    outbound.BasicOption{Interface: p.Interface},
+				Name:           p.Name,
+				Server:         p.Server,
+				Port:           p.Port,
+				UserName:       p.Username,
+				Password:       p.Password,
+				TLS:            p.TLS,
+				SkipCertVerify: p.SkipCertVerify,
+			})
+		default:
+			return nil, fmt.Errorf("Proxy %s unsupport type: %s", p.Name, p.Type)
+		}
+		proxies[p.Name] = adapter.NewProxy(proxyAdapter)
+	}
+	return proxies, nil
 }
 
 func parseHosts(cfg *RawConfig) (*trie.DomainTrie, error) {
 	tree := trie.New()
 
 	// add default hosts
-	if err := tree.Insert("localhost", net.IP{127, 0, 0, 1}); err != nil {
+	if err := tree.Insert("localhost", &resolver.HostRecord{IPs: []net.IP{{127, 0, 0, 1}}}); err != nil {
 		logrus.Errorln("insert localhost to host error: ", err.Error())
 	}
 
-	if len(cfg.Hosts) != 0 {
-		for domain, ipStr := range cfg.Hosts {
-			ip := net.ParseIP(ipStr)
-			if ip == nil {
-				return nil, fmt.Errorf("%s is not a valid IP", ipStr)
+	records := map[string]*resolver.HostRecord{}
+	// the hosts files first, overridden by the Hosts section
+	for _, file := range cfg.HostsFiles {
+		if err := parseHostsFile(constant.Path.Resolve(file), records); err != nil {
+			return nil, fmt.Errorf("HostsFiles %s: %s", file, err.Error())
+		}
+	}
+	for domain, raw := range cfg.Hosts {
+		record, err := parseHostRecord(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Hosts %s: %s", domain, err.Error())
+		}
+		records[strings.ToLower(strings.TrimRight(domain, "."))] = record
+	}
+
+	// generate the reverse entries of exact names, unless defined explicitly
+	reverse := map[string]*resolver.HostRecord{}
+	for domain, record := range records {
+		if strings.ContainsAny(domain, "*+") || strings.HasPrefix(domain, ".") {
+			continue
+		}
+		for _, ip := range record.IPs {
+			arpa, err := D.ReverseAddr(ip.String())
+			if err != nil {
+				continue
+			}
+			arpa = strings.TrimRight(arpa, ".")
+			if _, ok := records[arpa]; ok {
+				continue
+			}
+			if reverse[arpa] == nil {
+				reverse[arpa] = &resolver.HostRecord{}
 			}
-			_ = tree.Insert(domain, ip)
+			reverse[arpa].PTR = append(reverse[arpa].PTR, domain)
 		}
 	}
 
+	for domain, record := range records {
+		if err := tree.Insert(domain, record); err != nil {
+			return nil, fmt.Errorf("Hosts %s: %s", domain, err.Error())
+		}
+	}
+	for arpa, record := range reverse {
+		_ = tree.Insert(arpa, record)
+	}
+
 	return tree, nil
 }
 
+// parseHostRecord parse the value of Hosts, which is one of
+//
+//	127.0.0.1
+//	[127.0.0.1, '::1']
+//	{IP: [...], CNAME: target, TXT: [...], MX: ['10 mail.dev'], SRV: ['10 5 5060 sip.dev'], PTR: [...]}
+func parseHostRecord(raw any) (*resolver.HostRecord, error) {
+	record := &resolver.HostRecord{}
+	switch value := raw.(type) {
+	case string, []any:
+		ips, err := parseHostIPs(value)
+		if err != nil {
+			return nil, err
+		}
+		record.IPs = ips
+	case map[string]any:
+		for key, field := range value {
+			items, err := toStringSlice(field)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s", key, err.Error())
+			}
+			switch strings.ToLower(key) {
+			case "ip":
+				if record.IPs, err = parseHostIPs(field); err != nil {
+					return nil, err
+				}
+			case "cname":
+				if len(items) != 1 {
+					return nil, fmt.Errorf("CNAME must be one target")
+				}
+				record.CNAME = items[0]
+			case "txt":
+				record.TXT = items
+			case "mx":
+				for _, item := range items {
+					var mx resolver.MX
+					if _, err = fmt.Sscanf(item, "%d %s", &mx.Preference, &mx.Host); err != nil {
+						return nil, fmt.Errorf("MX %s format error: %s", item, err.Error())
+					}
+					record.MX = append(record.MX, mx)
+				}
+			case "srv":
+				for _, item := range items {
+					var srv resolver.SRV
+					if _, err = fmt.Sscanf(item, "%d %d %d %s", &srv.Priority, &srv.Weight, &srv.Port, &srv.Target); err != nil {
+						return nil, fmt.Errorf("SRV %s format error: %s", item, err.Error())
+					}
+					record.SRV = append(record.SRV, srv)
+				}
+			case "ptr":
+				record.PTR = items
+			default:
+				return nil, fmt.Errorf("unsupport record type: %s", key)
+			}
+		}
+		if record.CNAME != "" && (len(record.IPs) != 0 || len(record.TXT) != 0 || len(record.MX) != 0 ||
+			len(record.SRV) != 0 || len(record.PTR) != 0) {
+			return nil, fmt.Errorf("CNAME can not coexist with other records")
+		}
+	default:
+		return nil, fmt.Errorf("unsupport value: %v", raw)
+	}
+	return record, nil
+}
+
+func parseHostIPs(raw any) ([]net.IP, error) {
+	items, err := toStringSlice(raw)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, item := range items {
+		ip := net.ParseIP(item)
+		if ip == nil {
+			return nil, fmt.Errorf("%s is not a valid IP", item)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func toStringSlice(raw any) ([]string, error) {
+	switch value := raw.(type) {
+	case string:
+		return []string{value}, nil
+	case []any:
+		var items []string
+		for _, item := range value {
+			str, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v is not a string", item)
+			}
+			items = append(items, str)
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("%v is not a string or list", raw)
+	}
+}
+
+// parseHostsFile parse the /etc/hosts format file, the ips of a name are merged
+func parseHostsFile(path string, records map[string]*resolver.HostRecord) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// strip the zone of link-local address, e.g. fe80::1%lo0
+		ip := net.ParseIP(strings.SplitN(fields[0], "%", 2)[0])
+		if ip == nil {
+			continue
+		}
+		for _, domain := range fields[1:] {
+			domain = strings.ToLower(strings.TrimRight(domain, "."))
+			if records[domain] == nil {
+				records[domain] = &resolver.HostRecord{}
+			}
+			records[domain].IPs = append(records[domain].IPs, ip)
+		}
+	}
+	return scanner.Err()
+}
+
 func hostWithDefaultPort(host string, defPort string) (string, error) {
 	if !strings.Contains(host, ":") {
 		host += ":"
@@ -225,7 +709,7 @@ func hostWithDefaultPort(host string, defPort string) (string, error) {
 	return net.JoinHostPort(hostname, port), nil
 }
 
-func parseNameServer(servers []string) ([]dns.NameServer, error) {
+func parseNameServer(servers []string, proxies map[string]constant.Proxy) ([]dns.NameServer, error) {
 	var nameservers []dns.NameServer
 	for idx, server := range servers {
 		// parse without scheme .e.g 8.8.8.8:53
@@ -237,9 +721,32 @@ func parseNameServer(servers []string) ([]dns.NameServer, error) {
 			return nil, fmt.Errorf("DNS NameServer[%d] format error: %s", idx, err.Error())
 		}
 
-		// parse with specific interface
+		// parse with specific interface or proxy
 		// .e.g 10.0.0.1#en0
-		interfaceName := u.Fragment
+		// .e.g https://1.1.1.1/dns-query#proxy=corp-socks
+		// .e.g tls://1.1.1.1#interface=en0&proxy=corp-socks
+		// .e.g 8.8.8.8#ecs=client&ecs-prefix=24&ecs-prefix6=56
+		interfaceName, proxyName := u.Fragment, ""
+		var ecs *dns.ECSConfig
+		if strings.Contains(u.Fragment, "=") {
+			params, err := url.ParseQuery(u.Fragment)
+			if err != nil {
+				return nil, fmt.Errorf("DNS NameServer[%d] format error: %s", idx, err.Error())
+			}
+			interfaceName = params.Get("interface")
+			proxyName = params.Get("proxy")
+			if ecs, err = parseECS(params); err != nil {
+				return nil, fmt.Errorf("DNS NameServer[%d] %s", idx, err.Error())
+			}
+		}
+		if proxyName == "DIRECT" {
+			proxyName = ""
+		}
+		if proxyName != "" {
+			if _, exist := proxies[proxyName]; !exist {
+				return nil, fmt.Errorf("DNS NameServer[%d] proxy %s not found", idx, proxyName)
+			}
+		}
 
 		var addr, dnsNetType string
 		switch u.Scheme {
@@ -257,6 +764,9 @@ func parseNameServer(servers []string) ([]dns.NameServer, error) {
 			addr = clearURL.String()
 			dnsNetType = "https" // DNS over HTTPS
 		case "dhcp":
+			if proxyName != "" {
+				return nil, fmt.Errorf("DNS NameServer[%d] dhcp can not use proxy", idx)
+			}
 			addr = u.Host
 			dnsNetType = "dhcp" // UDP from DHCP
 		default:
@@ -270,31 +780,323 @@ func parseNameServer(servers []string) ([]dns.NameServer, error) {
 		nameservers = append(
 			nameservers,
 			dns.NameServer{
-				Net:       dnsNetType,
-				Addr:      addr,
-				Interface: interfaceName,
+				Net:          dnsNetType,
+				Addr:         addr,
+				Interface:    interfaceName,
+				ProxyAdapter: proxyName,
+				ECS:          ecs,
 			},
 		)
 	}
 	return nameservers, nil
 }
 
-func parseDNS(rawCfg *RawConfig, hosts *trie.DomainTrie) (*DNS, error) {
+// parseECS parse the EDNS Client Subnet of nameserver, ecs is "client"
+// to send the subnet of client, or a fixed subnet
+func parseECS(params url.Values) (*dns.ECSConfig, error) {
+	value := params.Get("ecs")
+	if value == "" {
+		return nil, nil
+	}
+
+	ecs := &dns.ECSConfig{
+		IPv4Prefix: dns.DefaultECSIPv4Prefix,
+		IPv6Prefix: dns.DefaultECSIPv6Prefix,
+	}
+	if value != "client" {
+		_, subnet, err := net.ParseCIDR(value)
+		if err != nil {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("ecs %s is not a valid subnet", value)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			subnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		ecs.Subnet = subnet
+		return ecs, nil
+	}
+
+	for key, prefix := range map[string]*int{"ecs-prefix": &ecs.IPv4Prefix, "ecs-prefix6": &ecs.IPv6Prefix} {
+		value := params.Get(key)
+		if value == "" {
+			continue
+		}
+		limit := 32
+		if key == "ecs-prefix6" {
+			limit = 128
+		}
+		if _, err := fmt.Sscanf(value, "%d", prefix); err != nil || *prefix < 0 || *prefix > limit {
+			return nil, fmt.Errorf("%s %s must be 0-%d", key, value, limit)
+		}
+	}
+	return ecs, nil
+}
+
+func parseDNS(rawCfg *RawConfig, hosts *trie.DomainTrie, proxies map[string]constant.Proxy) (*DNS, error) {
 	cfg := rawCfg.DNS
 	dnsCfg := &DNS{
-		Enable: cfg.Enable,
-		Listen: cfg.Listen,
-		Port:   cfg.Port,
-		Hosts:  hosts,
+		Enable:       cfg.Enable,
+		Listen:       cfg.Listen,
+		Port:         cfg.Port,
+		QueryLogSize: cfg.QueryLogSize,
+		PersistCache: cfg.PersistCache,
+		Hosts:        hosts,
 	}
 	var err error
-	if dnsCfg.NameServers, err = parseNameServer(cfg.NameServers); err != nil {
+	if dnsCfg.NameServers, err = parseNameServer(cfg.NameServers, proxies); err != nil {
+		return nil, err
+	}
+	if dnsCfg.Strategy, err = dns.ParseStrategy(cfg.Strategy); err != nil {
+		return nil, fmt.Errorf("DNS %s", err.Error())
+	}
+	if dnsCfg.FastestN = cfg.FastestN; dnsCfg.FastestN <= 0 {
+		dnsCfg.FastestN = 2
+	}
+	if dnsCfg.Blocker, err = parseBlocklist(cfg.Blocklist); err != nil {
+		return nil, err
+	}
+	if dnsCfg.Cache, err = parseDNSCache(cfg.Cache); err != nil {
+		return nil, err
+	}
+	if dnsCfg.DNSSEC, err = parseDNSSEC(cfg.DNSSEC); err != nil {
+		return nil, err
+	}
+	if dnsCfg.ACL, err = parseDNSACL(cfg.ACL, rawCfg.WhiteList); err != nil {
+		return nil, err
+	}
+	if dnsCfg.Local, err = parseDNSLocal(cfg.Local, proxies); err != nil {
+		return nil, err
+	}
+	if dnsCfg.DNS64, err = parseDNS64(cfg.DNS64); err != nil {
+		return nil, err
+	}
+	if dnsCfg.Hijack, err = parseHijack(cfg.Hijack); err != nil {
 		return nil, err
 	}
 
 	return dnsCfg, nil
 }
 
+func parseDNSCache(cfg *RawDNSCache) (dns.CacheConfig, error) {
+	if cfg == nil {
+		return dns.CacheConfig{}, nil
+	}
+	if cfg.MaxTTL != 0 && cfg.MinTTL > cfg.MaxTTL {
+		return dns.CacheConfig{}, fmt.Errorf("DNS Cache MinTTL %d greater than MaxTTL %d", cfg.MinTTL, cfg.MaxTTL)
+	}
+	if cfg.ServeStale < 0 {
+		return dns.CacheConfig{}, fmt.Errorf("DNS Cache ServeStale %d is negative", cfg.ServeStale)
+	}
+	return dns.CacheConfig{
+		MinTTL:        cfg.MinTTL,
+		MaxTTL:        cfg.MaxTTL,
+		StaleWindow:   time.Duration(cfg.ServeStale) * time.Second,
+		StaleTTL:      cfg.StaleTTL,
+		Prefetch:      cfg.Prefetch,
+		PrefetchHits:  cfg.PrefetchHits,
+		NegativeCache: cfg.NegativeCache,
+	}, nil
+}
+
+// parseHijack parse the destinations of dns traffic to hijack
+//
+//	any:53
+//	8.8.8.8
+//	[2001:4860:4860::8888]:53
+func parseHijack(addrs []string) ([]tunnel.HijackRule, error) {
+	var rules []tunnel.HijackRule
+	for idx, addr := range addrs {
+		host, err := hostWithDefaultPort(addr, "53")
+		if ip := net.ParseIP(addr); ip != nil {
+			host, err = net.JoinHostPort(addr, "53"), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("DNS Hijack[%d] format error: %s", idx, err.Error())
+		}
+		hostname, port, _ := net.SplitHostPort(host)
+
+		rule := tunnel.HijackRule{Port: port}
+		if hostname != "any" {
+			if rule.IP = net.ParseIP(hostname); rule.IP == nil {
+				return nil, fmt.Errorf("DNS Hijack[%d] %s is not a valid IP", idx, hostname)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseDNS64(cfg *RawDNS64) (*net.IPNet, error) {
+	if cfg == nil || !cfg.Enable {
+		return nil, nil
+	}
+	if cfg.Prefix == "" {
+		return resolver.WellKnownNAT64Prefix, nil
+	}
+
+	_, prefix, err := net.ParseCIDR(cfg.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("DNS DNS64 Prefix %s", err.Error())
+	}
+	if !resolver.ValidNAT64Prefix(prefix) {
+		return nil, fmt.Errorf("DNS DNS64 Prefix %s length must be one of 32, 40, 48, 56, 64 and 96", cfg.Prefix)
+	}
+	return prefix, nil
+}
+
+func parseDNSLocal(cfg *RawDNSLocal, proxies map[string]constant.Proxy) (*dns.LocalConfig, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	nameservers, err := parseNameServer(cfg.NameServers, proxies)
+	if err != nil {
+		return nil, fmt.Errorf("DNS Local %s", err.Error())
+	}
+	if len(nameservers) == 0 && len(cfg.SearchDomains) != 0 {
+		return nil, fmt.Errorf("DNS Local SearchDomains require NameServers")
+	}
+	for idx, domain := range cfg.SearchDomains {
+		if _, ok := trie.ValidAndSplitDomain(strings.Trim(domain, ".")); !ok {
+			return nil, fmt.Errorf("DNS Local SearchDomains[%d] invalid domain: %s", idx, domain)
+		}
+	}
+	if len(nameservers) == 0 && !cfg.PrivateReverse {
+		return nil, nil
+	}
+
+	return &dns.LocalConfig{
+		NameServers:    nameservers,
+		SearchDomains:  cfg.SearchDomains,
+		PrivateReverse: cfg.PrivateReverse,
+	}, nil
+}
+
+func parseDNSACL(cfg *RawDNSACL, whitelist []string) (*dns.ACLConfig, error) {
+	if cfg == nil {
+		cfg = &RawDNSACL{Slip: 2, RefuseAny: true}
+	}
+	if cfg.RateLimit < 0 || cfg.Burst < 0 || cfg.Slip < 0 {
+		return nil, fmt.Errorf("DNS ACL RateLimit, Burst and Slip must not be negative")
+	}
+
+	allow := cfg.Allow
+	if len(allow) == 0 {
+		allow = whitelist
+	}
+	subnets, err := parseSubnets(allow)
+	if err != nil {
+		return nil, fmt.Errorf("DNS ACL %s", err.Error())
+	}
+
+	return &dns.ACLConfig{
+		Allow:     subnets,
+		RateLimit: cfg.RateLimit,
+		Burst:     cfg.Burst,
+		Slip:      cfg.Slip,
+		RefuseAny: cfg.RefuseAny,
+	}, nil
+}
+
+// parseSubnets parse the ips and subnets, nil means all allowed.
+// the loopback and local addresses are always allowed
+func parseSubnets(IPCIDR []string) ([]*net.IPNet, error) {
+	if len(IPCIDR) == 0 {
+		return nil, nil
+	}
+	var subnets []*net.IPNet
+	for _, ipMask := range IPCIDR {
+		if ipMask == "0.0.0.0" || ipMask == "::" || ipMask == "*" || ipMask == "all" {
+			return nil, nil
+		}
+		if ip := net.ParseIP(ipMask); ip != nil {
+			subnets = append(subnets, hostSubnet(ip))
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(ipMask)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid IP or CIDR", ipMask)
+		}
+		subnets = append(subnets, subnet)
+	}
+
+	subnets = append(subnets, hostSubnet(net.IPv6loopback), &net.IPNet{IP: net.IP{127, 0, 0, 0}, Mask: net.CIDRMask(8, 32)})
+	ifaces, err := iface.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		for _, ipNet := range iface.Addrs {
+			subnets = append(subnets, hostSubnet(ipNet.IP))
+		}
+	}
+	return subnets, nil
+}
+
+func hostSubnet(ip net.IP) *net.IPNet {
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func parseDNSSEC(cfg *RawDNSSEC) (*dns.DNSSECConfig, error) {
+	if cfg == nil || !cfg.Enable {
+		return nil, nil
+	}
+
+	anchors, err := dns.ParseTrustAnchors(cfg.TrustAnchors)
+	if err != nil {
+		return nil, fmt.Errorf("DNS DNSSEC %s", err.Error())
+	}
+	for idx, domain := range cfg.NegativeTrustAnchors {
+		if _, ok := trie.ValidAndSplitDomain(domain); !ok {
+			return nil, fmt.Errorf("DNS DNSSEC NegativeTrustAnchors[%d] invalid domain: %s", idx, domain)
+		}
+	}
+
+	return &dns.DNSSECConfig{
+		TrustAnchors:         anchors,
+		NegativeTrustAnchors: cfg.NegativeTrustAnchors,
+	}, nil
+}
+
+func parseBlocklist(cfg *RawBlocklist) (*dns.BlockerConfig, error) {
+	if cfg == nil || !cfg.Enable {
+		return nil, nil
+	}
+
+	mode, err := dns.ParseBlockMode(cfg.Mode)
+	if err != nil {
+		return nil, fmt.Errorf("DNS Blocklist %s", err.Error())
+	}
+
+	names := map[string]bool{}
+	for idx, list := range cfg.Lists {
+		if list.Name == "" || list.Source == "" {
+			return nil, fmt.Errorf("DNS Blocklist[%d] missing name or source", idx)
+		}
+		if !dns.ValidBlockListName(list.Name) {
+			return nil, fmt.Errorf("DNS Blocklist %s name must be letters, digits, '_' or '-'", list.Name)
+		}
+		if names[list.Name] {
+			return nil, fmt.Errorf("DNS Blocklist %s is the duplicate name", list.Name)
+		}
+		names[list.Name] = true
+	}
+
+	return &dns.BlockerConfig{
+		Mode:     mode,
+		Interval: time.Duration(cfg.Interval) * time.Second,
+		Lists:    cfg.Lists,
+		Allow:    cfg.Allow,
+	}, nil
+}
+
 func parseAuthentication(rawRecords map[string]string) []auth.AuthUser {
 	var users []auth.AuthUser
 	for user, pass := range rawRecords {
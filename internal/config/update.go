@@ -0,0 +1,279 @@
+package config
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/xmapst/mixed-socks/internal/component/logs"
+	"github.com/xmapst/mixed-socks/internal/constant"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Redacted replace the secrets in the effective config,
+// the value sent back unchanged keeps the secret
+const Redacted = "******"
+
+var (
+	updateMux sync.Mutex
+	// settings is the effective config, differ from the file if not persisted
+	settings map[string]any
+	// written is the checksum of the file persisted by Update, the change of file is ignored
+	written  [sha256.Size]byte
+	changeCh chan bool
+)
+
+// PersistError is the failure of writing the config file, the config is valid
+type PersistError struct {
+	Err error
+}
+
+func (e *PersistError) Error() string {
+	return "persist config: " + e.Err.Error()
+}
+
+func (e *PersistError) Unwrap() error {
+	return e.Err
+}
+
+// Effective return the config in use with the secrets redacted
+func Effective() (*RawConfig, error) {
+	updateMux.Lock()
+	vp, err := newViper(settings)
+	updateMux.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := unmarshalRawConfig(vp)
+	if err != nil {
+		return nil, err
+	}
+	raw.redact()
+	return raw, nil
+}
+
+// Update validate and apply the config, it is merged into the config in use
+// unless replace. The config file is rewritten if persist
+func Update(patch map[string]any, replace, persist bool) error {
+	if changeCh == nil {
+		return errors.New("config not loaded")
+	}
+
+	updateMux.Lock()
+	defer updateMux.Unlock()
+
+	restored, err := restoreRedacted(normalizeKeys(patch), settings, "")
+	if err != nil {
+		return err
+	}
+	patch = restored.(map[string]any)
+	next := patch
+	if !replace {
+		next = mergeSettings(copySettings(settings), patch)
+	}
+
+	vp, err := newViper(next)
+	if err != nil {
+		return err
+	}
+	raw, err := unmarshalRawConfig(vp)
+	if err != nil {
+		return err
+	}
+	cfg, err := raw.parse()
+	if err != nil {
+		return err
+	}
+	// the output of logger is opened at once, an unreachable syslog fails the update.
+	// It is installed only when the update is committed
+	var output *logs.Output
+	if cfg.Log != nil {
+		if output, err = logs.Open(cfg.Log.Config()); err != nil {
+			return err
+		}
+	}
+
+	if persist {
+		if err = writeConfig(vp, constant.Path.Config()); err != nil {
+			if output != nil {
+				output.Close()
+			}
+			return &PersistError{Err: err}
+		}
+		logrus.Infoln(constant.Path.Config(), "config file persisted")
+	}
+
+	if output != nil {
+		output.Install()
+	}
+
+	App = cfg
+	settings = next
+	changeCh <- true
+	return nil
+}
+
+// writeConfig write to a temp file and rename it, the watcher never see a partial file
+func writeConfig(vp *viper.Viper, file string) error {
+	// keep the extension, viper decide the format by it
+	tmp := filepath.Join(filepath.Dir(file), "."+filepath.Base(file))
+	if err := vp.WriteConfigAs(tmp); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(tmp)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, file); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	written = sha256.Sum256(data)
+	return nil
+}
+
+// redact replace the password and secret
+func (c *RawConfig) redact() {
+	if c.Controller != nil && c.Controller.Secret != "" {
+		c.Controller.Secret = Redacted
+	}
+	for user := range c.Auth {
+		c.Auth[user] = Redacted
+	}
+	if c.Outbound != nil {
+		for _, proxy := range c.Outbound.Proxies {
+			if proxy.Password != "" {
+				proxy.Password = Redacted
+			}
+		}
+	}
+}
+
+func newViper(settings map[string]any) (*viper.Viper, error) {
+	vp := viper.NewWithOptions(viper.KeyDelimiter("::"))
+	vp.SetConfigType("yaml")
+	if err := vp.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+	return vp, nil
+}
+
+// normalizeKeys lower the keys as viper does
+func normalizeKeys(value any) any {
+	switch val := value.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(val))
+		for k, v := range val {
+			m[strings.ToLower(k)] = normalizeKeys(v)
+		}
+		return m
+	case []any:
+		s := make([]any, len(val))
+		for i, v := range val {
+			s[i] = normalizeKeys(v)
+		}
+		return s
+	default:
+		return value
+	}
+}
+
+// restoreRedacted take the secrets from old where the value is Redacted, the items
+// of list are matched by their identity. The Redacted value without a secret is rejected
+func restoreRedacted(value, old any, path string) (any, error) {
+	switch val := value.(type) {
+	case string:
+		if val == Redacted {
+			if old == nil {
+				return nil, fmt.Errorf("%s: no secret to restore the redacted value", path)
+			}
+			return old, nil
+		}
+	case map[string]any:
+		oldMap, _ := old.(map[string]any)
+		for k, v := range val {
+			sub := k
+			if path != "" {
+				sub = path + "." + k
+			}
+			restored, err := restoreRedacted(v, oldMap[k], sub)
+			if err != nil {
+				return nil, err
+			}
+			val[k] = restored
+		}
+	case []any:
+		oldSlice, _ := old.([]any)
+		for i, v := range val {
+			restored, err := restoreRedacted(v, matchItem(v, oldSlice), fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			val[i] = restored
+		}
+	}
+	return value, nil
+}
+
+// itemKeys identify the items of list, the secret follows the item wherever it moves
+var itemKeys = []string{"name", "username", "address", "server"}
+
+// matchItem find the item in old with the same identity
+func matchItem(item any, old []any) any {
+	m, ok := item.(map[string]any)
+	if !ok {
+		return nil
+	}
+	for _, key := range itemKeys {
+		id, ok := m[key].(string)
+		if !ok {
+			continue
+		}
+		for _, o := range old {
+			if om, ok := o.(map[string]any); ok && om[key] == id {
+				return o
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// mergeSettings merge the patch into dst like JSON merge patch (RFC 7396),
+// null remove the key
+func mergeSettings(dst, patch map[string]any) map[string]any {
+	for k, v := range patch {
+		if v == nil {
+			delete(dst, k)
+			continue
+		}
+		src, ok := v.(map[string]any)
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		if sub, ok := dst[k].(map[string]any); ok {
+			dst[k] = mergeSettings(sub, src)
+		} else {
+			dst[k] = src
+		}
+	}
+	return dst
+}
+
+func copySettings(settings map[string]any) map[string]any {
+	m := make(map[string]any, len(settings))
+	for k, v := range settings {
+		if sub, ok := v.(map[string]any); ok {
+			v = copySettings(sub)
+		}
+		m[k] = v
+	}
+	return m
+}
@@ -11,6 +11,8 @@ import (
 // Adapter Type
 const (
 	Direct AdapterType = iota
+	Socks5
+	Http
 )
 
 const (
@@ -110,6 +112,10 @@ func (at AdapterType) String() string {
 	switch at {
 	case Direct:
 		return "Direct"
+	case Socks5:
+		return "Socks5"
+	case Http:
+		return "Http"
 	default:
 		return "Unknown"
 	}
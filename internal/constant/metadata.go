@@ -63,6 +63,10 @@ type Metadata struct {
 	DstPort     string  `json:"destinationPort"`
 	Host        string  `json:"host"`
 	ProcessPath string  `json:"processPath"`
+	// User is the authenticated user of inbound, empty if auth disabled
+	User string `json:"user"`
+	// RemoteDst is the address actually connected
+	RemoteDst string `json:"remoteDestination"`
 }
 
 func (m *Metadata) RemoteAddress() string {
@@ -7,9 +7,11 @@ import (
 )
 
 const (
-	DNSTypeHost  = "host"
-	DNSTypeRaw   = "raw"
-	DNSTypeCache = "cache"
+	DNSTypeHost    = "host"
+	DNSTypeRaw     = "raw"
+	DNSTypeCache   = "cache"
+	DNSTypeBlock   = "block"
+	DNSTypeRefused = "refused"
 )
 
 type DNSContext struct {
@@ -18,6 +20,8 @@ type DNSContext struct {
 	localAddr  net.Addr
 	msg        *dns.Msg
 	tp         string
+	upstream   string
+	cacheHit   bool
 }
 
 func NewDNSContext(localAddr, remoteAddr net.Addr, msg *dns.Msg) *DNSContext {
@@ -54,3 +58,23 @@ func (c *DNSContext) LocalAddr() net.Addr {
 func (c *DNSContext) RemoteAddr() net.Addr {
 	return c.remoteAddr
 }
+
+// SetUpstream set the upstream which answered the request
+func (c *DNSContext) SetUpstream(upstream string) {
+	c.upstream = upstream
+}
+
+// Upstream return the upstream which answered the request
+func (c *DNSContext) Upstream() string {
+	return c.upstream
+}
+
+// SetCacheHit set whether the response come from cache
+func (c *DNSContext) SetCacheHit(hit bool) {
+	c.cacheHit = hit
+}
+
+// CacheHit return whether the response come from cache
+func (c *DNSContext) CacheHit() bool {
+	return c.cacheHit
+}
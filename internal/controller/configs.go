@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/xmapst/mixed-socks/internal/config"
+	"net/http"
+	"strconv"
+)
+
+func configRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/", getConfigs)
+	r.Patch("/", patchConfigs)
+	r.Put("/", updateConfigs)
+	return r
+}
+
+func getConfigs(w http.ResponseWriter, r *http.Request) {
+	cfg, err := config.Effective()
+	if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, newError(err.Error()))
+		return
+	}
+	render.JSON(w, r, cfg)
+}
+
+// patchConfigs merge the body into the config in use
+func patchConfigs(w http.ResponseWriter, r *http.Request) {
+	applyConfigs(w, r, false)
+}
+
+// updateConfigs replace the config in use with the body
+func updateConfigs(w http.ResponseWriter, r *http.Request) {
+	applyConfigs(w, r, true)
+}
+
+func applyConfigs(w http.ResponseWriter, r *http.Request, replace bool) {
+	var persist bool
+	if persistStr := r.URL.Query().Get("persist"); persistStr != "" {
+		var err error
+		if persist, err = strconv.ParseBool(persistStr); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, ErrBadRequest)
+			return
+		}
+	}
+
+	var body map[string]any
+	if err := render.DecodeJSON(r.Body, &body); err != nil || body == nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrBadRequest)
+		return
+	}
+
+	if err := config.Update(body, replace, persist); err != nil {
+		// the config is valid, but the file can't be written
+		var persistErr *config.PersistError
+		if errors.As(err, &persistErr) {
+			render.Status(r, http.StatusInternalServerError)
+		} else {
+			render.Status(r, http.StatusBadRequest)
+		}
+		render.JSON(w, r, newError(err.Error()))
+		return
+	}
+	getConfigs(w, r)
+}
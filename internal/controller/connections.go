@@ -3,32 +3,39 @@ package controller
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
 	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
 	"github.com/xmapst/mixed-socks/internal/tunnel/statistic"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
 func connectionRouter() http.Handler {
 	r := chi.NewRouter()
 	r.Get("/", getConnections)
-	r.Delete("/", closeAllConnections)
+	r.Get("/closed", getClosedConnections)
+	r.Delete("/", closeConnections)
 	r.Delete("/{id}", closeConnection)
 	return r
 }
 
 func getConnections(w http.ResponseWriter, r *http.Request) {
-	if !websocket.IsWebSocketUpgrade(r) {
-		snapshot := statistic.DefaultManager.Snapshot()
-		render.JSON(w, r, snapshot)
+	query, err := parseConnectionQuery(r)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, newError(err.Error()))
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
+	if !websocket.IsWebSocketUpgrade(r) {
+		snapshot := statistic.DefaultManager.Query(query)
+		render.JSON(w, r, snapshot)
 		return
 	}
 
@@ -36,7 +43,7 @@ func getConnections(w http.ResponseWriter, r *http.Request) {
 	interval := 1000
 	if intervalStr != "" {
 		t, err := strconv.Atoi(intervalStr)
-		if err != nil {
+		if err != nil || t <= 0 {
 			render.Status(r, http.StatusBadRequest)
 			render.JSON(w, r, ErrBadRequest)
 			return
@@ -45,17 +52,40 @@ func getConnections(w http.ResponseWriter, r *http.Request) {
 		interval = t
 	}
 
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
 	buf := &bytes.Buffer{}
-	sendSnapshot := func() error {
+	send := func(v any) error {
 		buf.Reset()
-		snapshot := statistic.DefaultManager.Snapshot()
-		if err := json.NewEncoder(buf).Encode(snapshot); err != nil {
+		if err := json.NewEncoder(buf).Encode(v); err != nil {
 			return err
 		}
 
 		return conn.WriteMessage(websocket.TextMessage, buf.Bytes())
 	}
 
+	// only the opened, closed and updated connections are sent in diff mode
+	var sendSnapshot func() error
+	if diff, _ := strconv.ParseBool(r.URL.Query().Get("diff")); diff {
+		differ := statistic.NewDiffer(query)
+		first := true
+		sendSnapshot = func() error {
+			d := differ.Next(statistic.DefaultManager)
+			if d.Empty() && !first {
+				return nil
+			}
+			first = false
+			return send(d)
+		}
+	} else {
+		sendSnapshot = func() error {
+			return send(statistic.DefaultManager.Query(query))
+		}
+	}
+
 	if err := sendSnapshot(); err != nil {
 		return
 	}
@@ -69,22 +99,99 @@ func getConnections(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func closeConnection(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	snapshot := statistic.DefaultManager.Snapshot()
-	for _, c := range snapshot.Connections {
-		if id == c.ID() {
-			_ = c.Close()
-			break
+// parseConnectionQuery parse the filter, sort and pagination of connections
+func parseConnectionQuery(r *http.Request) (*statistic.ConnectionQuery, error) {
+	params := r.URL.Query()
+	query := &statistic.ConnectionQuery{
+		Host:     params.Get("host"),
+		DstPort:  params.Get("port"),
+		Network:  params.Get("network"),
+		Type:     params.Get("type"),
+		User:     params.Get("user"),
+		Outbound: params.Get("outbound"),
+	}
+
+	if source := params.Get("source"); source != "" {
+		subnet, err := parseSource(source)
+		if err != nil {
+			return nil, err
 		}
+		query.Source = subnet
 	}
-	render.NoContent(w, r)
+
+	var err error
+	if query.SortBy, err = statistic.ParseSortBy(params.Get("sort")); err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(params.Get("order")) {
+	case "", "desc":
+	case "asc":
+		query.Asc = true
+	default:
+		return nil, fmt.Errorf("unsupport order: %s", params.Get("order"))
+	}
+
+	for key, value := range map[string]*int{"limit": &query.Limit, "offset": &query.Offset} {
+		str := params.Get(key)
+		if str == "" {
+			continue
+		}
+		if *value, err = strconv.Atoi(str); err != nil || *value < 0 {
+			return nil, fmt.Errorf("invalid %s: %s", key, str)
+		}
+	}
+	return query, nil
 }
 
-func closeAllConnections(w http.ResponseWriter, r *http.Request) {
-	snapshot := statistic.DefaultManager.Snapshot()
-	for _, c := range snapshot.Connections {
-		_ = c.Close()
+// parseSource parse the ip or cidr
+func parseSource(source string) (*net.IPNet, error) {
+	if strings.Contains(source, "/") {
+		_, subnet, err := net.ParseCIDR(source)
+		return subnet, err
+	}
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source: %s", source)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
 	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func closeConnection(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	statistic.DefaultManager.CloseWithReason(id, statistic.ReasonAPI)
 	render.NoContent(w, r)
 }
+
+// getClosedConnections return the recently closed connections and failed dials match the filter
+func getClosedConnections(w http.ResponseWriter, r *http.Request) {
+	query, err := parseConnectionQuery(r)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, newError(err.Error()))
+		return
+	}
+	connections, matched := statistic.DefaultManager.Closed(query)
+	if connections == nil {
+		connections = []*statistic.ClosedConnection{}
+	}
+	render.JSON(w, r, render.M{
+		"connections": connections,
+		"matched":     matched,
+	})
+}
+
+// closeConnections close the connections match the filter, all if no filter
+func closeConnections(w http.ResponseWriter, r *http.Request) {
+	query, err := parseConnectionQuery(r)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, newError(err.Error()))
+		return
+	}
+	closed := statistic.DefaultManager.CloseMatched(query)
+	logrus.Infof("[API] %d connections closed", closed)
+	render.JSON(w, r, render.M{"closed": closed})
+}
@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/gorilla/websocket"
+	"github.com/xmapst/mixed-socks/internal/component/resolver"
+	"github.com/xmapst/mixed-socks/internal/dns"
+	"net/http"
+	"strconv"
+)
+
+func dnsRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/queries", getDNSQueries)
+	r.Get("/stats", getDNSStats)
+	r.Get("/upstreams", getDNSUpstreams)
+	r.Get("/blocklists", getBlocklists)
+	r.Put("/blocklists", reloadBlocklists)
+	r.Get("/cache", getDNSCache)
+	r.Delete("/cache", flushDNSCache)
+	return r
+}
+
+func currentResolver() *dns.Resolver {
+	r, _ := resolver.DefaultResolver.(*dns.Resolver)
+	return r
+}
+
+func getDNSUpstreams(w http.ResponseWriter, r *http.Request) {
+	res := currentResolver()
+	if res == nil {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, ErrNotFound)
+		return
+	}
+
+	render.JSON(w, r, render.M{
+		"strategy":  res.Strategy(),
+		"upstreams": res.Upstreams(),
+	})
+}
+
+func getDNSQueries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := &dns.QueryFilter{
+		Client:   query.Get("client"),
+		Name:     query.Get("name"),
+		QType:    query.Get("qtype"),
+		Rcode:    query.Get("rcode"),
+		Upstream: query.Get("upstream"),
+		Type:     query.Get("type"),
+	}
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, ErrBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	if !websocket.IsWebSocketUpgrade(r) {
+		render.JSON(w, r, render.M{
+			"queries": dns.DefaultQueryLog.Queries(filter),
+		})
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer func(conn *websocket.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	ch := dns.DefaultQueryLog.Subscribe()
+	defer dns.DefaultQueryLog.Unsubscribe(ch)
+
+	// detect the client gone away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case q := <-ch:
+			if !filter.Match(q) {
+				continue
+			}
+			if err := conn.WriteJSON(q); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+func getDNSStats(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, dns.DefaultQueryLog.Stats())
+}
+
+func getBlocklists(w http.ResponseWriter, r *http.Request) {
+	lists := []*dns.BlockList{}
+	if dnsResolver := currentResolver(); dnsResolver != nil && dnsResolver.Blocker() != nil {
+		lists = dnsResolver.Blocker().Lists()
+	}
+	render.JSON(w, r, render.M{
+		"lists": lists,
+	})
+}
+
+func reloadBlocklists(w http.ResponseWriter, r *http.Request) {
+	dnsResolver := currentResolver()
+	if dnsResolver == nil || dnsResolver.Blocker() == nil {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, ErrNotFound)
+		return
+	}
+	go dnsResolver.Blocker().Reload(true)
+	render.NoContent(w, r)
+}
+
+func getDNSCache(w http.ResponseWriter, r *http.Request) {
+	entries := []*dns.CacheEntry{}
+	if dnsResolver := currentResolver(); dnsResolver != nil {
+		entries = dnsResolver.CacheEntries(r.URL.Query().Get("name"))
+	}
+	render.JSON(w, r, render.M{
+		"entries": entries,
+	})
+}
+
+func flushDNSCache(w http.ResponseWriter, r *http.Request) {
+	flushed := 0
+	if dnsResolver := currentResolver(); dnsResolver != nil {
+		flushed = dnsResolver.FlushCache(r.URL.Query().Get("name"))
+	}
+	render.JSON(w, r, render.M{
+		"flushed": flushed,
+	})
+}
@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"encoding/json"
+	"github.com/go-chi/render"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/mixed-socks/internal/component/logs"
+	"net/http"
+)
+
+// getLogs stream the log entries of the level and above, the entries below
+// the level of logger are never produced
+func getLogs(w http.ResponseWriter, r *http.Request) {
+	level := logrus.InfoLevel
+	if levelStr := r.URL.Query().Get("level"); levelStr != "" {
+		var err error
+		if level, err = logrus.ParseLevel(levelStr); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, ErrBadRequest)
+			return
+		}
+	}
+
+	ch, err := logs.DefaultHook.Subscribe(level)
+	if err != nil {
+		render.Status(r, http.StatusServiceUnavailable)
+		render.JSON(w, r, newError(err.Error()))
+		return
+	}
+	defer logs.DefaultHook.Unsubscribe(ch)
+
+	if !websocket.IsWebSocketUpgrade(r) {
+		w.Header().Set("Content-Type", "application/json")
+		render.Status(r, http.StatusOK)
+		encoder := json.NewEncoder(w)
+		for {
+			select {
+			case event, ok := <-ch:
+				if !ok {
+					return
+				}
+				if err = encoder.Encode(event); err != nil {
+					return
+				}
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer func(conn *websocket.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	// detect the client gone away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err = conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 	"github.com/xmapst/mixed-socks"
+	imetrics "github.com/xmapst/mixed-socks/internal/component/metrics"
 	"github.com/xmapst/mixed-socks/internal/tunnel/statistic"
 	"net"
 	"net/http"
@@ -55,7 +56,13 @@ func Start(addr string, secret string) {
 
 		r.Get("/api", hello)
 		r.Get("/api/traffic", traffic)
+		r.Get("/api/traffic/history", trafficHistory)
+		r.Get("/api/logs", getLogs)
 		r.Mount("/api/connections", connectionRouter())
+		r.Mount("/api/dns", dnsRouter())
+		r.Mount("/api/configs", configRouter())
+		r.Mount("/api/stats", statsRouter())
+		r.Get("/metrics", metrics)
 	})
 
 	l, err := net.Listen("tcp", addr)
@@ -119,6 +126,37 @@ func hello(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// metrics expose the metrics in Prometheus text format
+func metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = imetrics.DefaultRegistry.WriteTo(w)
+}
+
+// trafficHistory return the traffic samples of the resolution, globally or of
+// the user or outbound
+func trafficHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	res := query.Get("resolution")
+	if res == "" {
+		res = statistic.ResolutionSecond
+	}
+
+	history := statistic.DefaultManager.History()
+	samples, err := history.Samples(res, query.Get("user"), query.Get("outbound"))
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, newError(err.Error()))
+		return
+	}
+	users, outbounds := history.Keys()
+	render.JSON(w, r, render.M{
+		"resolution": res,
+		"samples":    samples,
+		"users":      users,
+		"outbounds":  outbounds,
+	})
+}
+
 func traffic(w http.ResponseWriter, r *http.Request) {
 	var wsConn *websocket.Conn
 	if websocket.IsWebSocketUpgrade(r) {
@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/xmapst/mixed-socks/internal/tunnel/statistic"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func statsRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/top", getTopTalkers)
+	return r
+}
+
+// getTopTalkers return the hosts, ips, sources or users with the most bytes in the window
+func getTopTalkers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	dimension := strings.ToLower(query.Get("by"))
+	if dimension == "" {
+		dimension = statistic.TopByHost
+	}
+
+	window := 5 * time.Minute
+	if windowStr := query.Get("window"); windowStr != "" {
+		var err error
+		if window, err = time.ParseDuration(windowStr); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, ErrBadRequest)
+			return
+		}
+	}
+
+	limit := 10
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, ErrBadRequest)
+			return
+		}
+	}
+
+	entries, err := statistic.DefaultManager.TopTalkers().Top(dimension, window, limit)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, newError(err.Error()))
+		return
+	}
+	render.JSON(w, r, render.M{
+		"by":      dimension,
+		"window":  window.String(),
+		"entries": entries,
+	})
+}
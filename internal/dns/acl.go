@@ -0,0 +1,150 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"github.com/xmapst/mixed-socks/internal/common/cache"
+	"net"
+	"sync"
+	"time"
+)
+
+// ACLConfig is the access control of the DNS server
+type ACLConfig struct {
+	// Allow is the client subnets allowed to query, empty means everyone
+	Allow []*net.IPNet
+	// RateLimit is the queries per second of a client, zero means unlimited
+	RateLimit float64
+	Burst     int
+	// Slip answer every Slip-th limited query with TC bit, so the real clients
+	// retry over TCP, and the others are dropped. zero means drop all
+	Slip int
+	// RefuseAny refuse the ANY queries, they are mostly used for amplification
+	RefuseAny bool
+}
+
+type aclAction int
+
+const (
+	aclAccept aclAction = iota
+	aclRefuse
+	aclTruncate
+	aclDrop
+)
+
+type tokenBucket struct {
+	mux     sync.Mutex
+	tokens  float64
+	last    time.Time
+	limited int
+}
+
+type accessControl struct {
+	cfg     *ACLConfig
+	buckets *cache.LruCache
+}
+
+// check decide how to handle the query of client
+func (a *accessControl) check(addr net.Addr, r *dns.Msg) aclAction {
+	ip := addrIP(addr)
+	if len(a.cfg.Allow) != 0 && !a.allowed(ip) {
+		return aclRefuse
+	}
+	if a.cfg.RefuseAny && r.Question[0].Qtype == dns.TypeANY {
+		return aclRefuse
+	}
+	// the source of tcp can't be spoofed, only udp is limited
+	if _, ok := addr.(*net.TCPAddr); ok || a.cfg.RateLimit <= 0 || ip == nil {
+		return aclAccept
+	}
+	return a.limit(ip.String())
+}
+
+func (a *accessControl) allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, subnet := range a.cfg.Allow {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *accessControl) limit(client string) aclAction {
+	now := time.Now()
+	burst := float64(a.cfg.Burst)
+	if burst < a.cfg.RateLimit {
+		burst = a.cfg.RateLimit
+	}
+
+	var bucket *tokenBucket
+	if v, ok := a.buckets.Get(client); ok {
+		bucket = v.(*tokenBucket)
+	} else {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		a.buckets.Set(client, bucket)
+	}
+
+	bucket.mux.Lock()
+	defer bucket.mux.Unlock()
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * a.cfg.RateLimit
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		bucket.limited = 0
+		return aclAccept
+	}
+
+	bucket.limited++
+	if a.cfg.Slip > 0 && bucket.limited%a.cfg.Slip == 0 {
+		return aclTruncate
+	}
+	return aclDrop
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func truncatedMsg(r *dns.Msg) *dns.Msg {
+	msg := &dns.Msg{}
+	msg.SetReply(r)
+	msg.Truncated = true
+	return msg
+}
+
+func refusedMsg(r *dns.Msg) *dns.Msg {
+	msg := &dns.Msg{}
+	msg.SetRcode(r, dns.RcodeRefused)
+	return msg
+}
+
+func newAccessControl(cfg *ACLConfig) *accessControl {
+	if cfg == nil {
+		return nil
+	}
+	return &accessControl{
+		cfg: cfg,
+		// the idle clients are forgotten, their buckets are full anyway
+		buckets: cache.New(cache.WithSize(65535), cache.WithAge(60), cache.WithUpdateAgeOnGet()),
+	}
+}
@@ -0,0 +1,476 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/mixed-socks/internal/component/dialer"
+	"github.com/xmapst/mixed-socks/internal/component/trie"
+	"github.com/xmapst/mixed-socks/internal/constant"
+	"go.uber.org/atomic"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BlockModeNXDomain = "nxdomain"
+	BlockModeNull     = "null"
+	BlockModeRefused  = "refused"
+
+	blockListTimeout = 30 * time.Second
+)
+
+// blockListName is the name of block list, it is the file name of the cache
+var blockListName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// fetchPolicy decide whether a remote list is fetched or read from cache
+type fetchPolicy int
+
+const (
+	// fetchNever read the cache only, the list is skipped if not cached
+	fetchNever fetchPolicy = iota
+	// fetchStale fetch the list if the cache is missing or expired
+	fetchStale
+	fetchForce
+)
+
+var errNotCached = errors.New("not cached yet")
+
+// BlockListConfig is a block list source, a local file or a url
+type BlockListConfig struct {
+	Name   string
+	Source string
+}
+
+type BlockerConfig struct {
+	Mode     string
+	Interval time.Duration
+	Lists    []BlockListConfig
+	Allow    []string
+}
+
+// BlockList is a loaded block list with hit counter
+type BlockList struct {
+	name      string
+	source    string
+	rules     *atomic.Int64
+	hits      *atomic.Int64
+	updatedAt *atomic.Time
+	err       *atomic.Error
+}
+
+// Name return the name of block list
+func (l *BlockList) Name() string {
+	return l.name
+}
+
+// Hit increase the hit counter
+func (l *BlockList) Hit() {
+	l.hits.Inc()
+}
+
+// MarshalJSON implements json.Marshaler
+func (l *BlockList) MarshalJSON() ([]byte, error) {
+	mapping := map[string]any{
+		"name":      l.name,
+		"source":    l.source,
+		"rules":     l.rules.Load(),
+		"hits":      l.hits.Load(),
+		"updatedAt": l.updatedAt.Load(),
+	}
+	if err := l.err.Load(); err != nil {
+		mapping["error"] = err.Error()
+	}
+	return json.Marshal(mapping)
+}
+
+type Blocker struct {
+	config   BlockerConfig
+	mode     string
+	interval time.Duration
+	lists    []*BlockList
+	allow    []string
+
+	mux   sync.RWMutex
+	block *trie.DomainTrie
+	pass  *trie.DomainTrie
+
+	// refs is the resolvers share the blocker, stopped once all closed
+	refs    *atomic.Int32
+	started sync.Once
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Mode return how blocked names are answered
+func (b *Blocker) Mode() string {
+	return b.mode
+}
+
+// Lists return the block lists
+func (b *Blocker) Lists() []*BlockList {
+	return b.lists
+}
+
+// Match return the block list which blocks the domain, nil if not blocked
+func (b *Blocker) Match(domain string) *BlockList {
+	b.mux.RLock()
+	block, pass := b.block, b.pass
+	b.mux.RUnlock()
+
+	if pass.Search(domain) != nil {
+		return nil
+	}
+	node := block.Search(domain)
+	if node == nil {
+		return nil
+	}
+	return node.Data.(*BlockList)
+}
+
+// Close stop refreshing the block lists if no other resolver shares it
+func (b *Blocker) Close() {
+	if b.refs.Dec() > 0 {
+		return
+	}
+	b.once.Do(func() {
+		close(b.done)
+	})
+}
+
+// retain share the blocker with another resolver
+func (b *Blocker) retain() *Blocker {
+	b.refs.Inc()
+	return b
+}
+
+// sameConfig return whether the blocker loads the same lists in the same way
+func (b *Blocker) sameConfig(o *Blocker) bool {
+	return reflect.DeepEqual(b.config, o.config)
+}
+
+// inherit keep the hits of the lists unchanged in the old blocker
+func (b *Blocker) inherit(o *Blocker) {
+	for _, list := range b.lists {
+		for _, old := range o.lists {
+			if list.name == old.name && list.source == old.source {
+				list.hits.Store(old.hits.Load())
+			}
+		}
+	}
+}
+
+// start load the local and cached lists at once, then fetch the remote lists
+// and refresh them in background. called once, the shared blocker is started already
+func (b *Blocker) start() {
+	b.started.Do(func() {
+		b.load(fetchNever)
+		// fetching remote lists may take a while, never block the DNS server
+		go func() {
+			if b.needFetch() {
+				b.load(fetchStale)
+			}
+			b.refresh()
+		}()
+	})
+}
+
+// needFetch return whether any remote list is not cached or expired
+func (b *Blocker) needFetch() bool {
+	for _, list := range b.lists {
+		if !isRemoteSource(list.source) {
+			continue
+		}
+		info, err := os.Stat(blockListCache(list))
+		if err != nil || time.Since(info.ModTime()) >= b.interval {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload reload all block lists, the remote lists are fetched again when force
+func (b *Blocker) Reload(force bool) {
+	policy := fetchStale
+	if force {
+		policy = fetchForce
+	}
+	b.load(policy)
+}
+
+func (b *Blocker) load(policy fetchPolicy) {
+	block, pass := trie.New(), trie.New()
+	for _, domain := range b.allow {
+		if err := pass.Insert(domain, true); err != nil {
+			logrus.Warnf("[DNS] blocklist allow %s: %s", domain, err)
+		}
+	}
+
+	for _, list := range b.lists {
+		rc, err := b.open(list, policy)
+		if errors.Is(err, errNotCached) {
+			continue
+		}
+		if err != nil {
+			list.err.Store(err)
+			logrus.Warnf("[DNS] load blocklist %s failed: %s", list.name, err)
+			continue
+		}
+		rules := parseBlockList(rc, list, block, pass)
+		_ = rc.Close()
+		list.rules.Store(rules)
+		list.err.Store(nil)
+		logrus.Infof("[DNS] blocklist %s loaded %d rules", list.name, rules)
+	}
+
+	b.mux.Lock()
+	b.block, b.pass = block, pass
+	b.mux.Unlock()
+}
+
+func (b *Blocker) open(list *BlockList, policy fetchPolicy) (io.ReadCloser, error) {
+	if !isRemoteSource(list.source) {
+		f, err := os.Open(constant.Path.Resolve(list.source))
+		if err != nil {
+			return nil, err
+		}
+		if info, err := f.Stat(); err == nil {
+			list.updatedAt.Store(info.ModTime())
+		}
+		return f, nil
+	}
+
+	// remote lists are cached, avoid fetching on every start or reload
+	if !ValidBlockListName(list.name) {
+		return nil, fmt.Errorf("invalid blocklist name %q", list.name)
+	}
+	cache := blockListCache(list)
+	info, err := os.Stat(cache)
+	if err == nil && (policy == fetchNever || policy == fetchStale && time.Since(info.ModTime()) < b.interval) {
+		list.updatedAt.Store(info.ModTime())
+		return os.Open(cache)
+	}
+	if policy == fetchNever {
+		return nil, errNotCached
+	}
+
+	if err := fetchBlockList(list.source, cache); err != nil {
+		// fetch failed, fallback to the stale cache
+		if f, cErr := os.Open(cache); cErr == nil {
+			logrus.Warnf("[DNS] fetch blocklist %s failed, use cache: %s", list.name, err)
+			return f, nil
+		}
+		return nil, err
+	}
+	list.updatedAt.Store(time.Now())
+	return os.Open(cache)
+}
+
+func (b *Blocker) refresh() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.Reload(true)
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// ValidBlockListName return whether the name is letters, digits, '_' or '-',
+// the name never escapes the cache directory
+func ValidBlockListName(name string) bool {
+	return blockListName.MatchString(name)
+}
+
+func blockListCache(list *BlockList) string {
+	return constant.Path.Resolve(filepath.Join("blocklists", list.name))
+}
+
+func isRemoteSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+func fetchBlockList(url, path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), blockListTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, resp.Body)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// parseBlockList parse the hosts, plain domain and adblock syntax, return count of block rules
+//
+//	0.0.0.0 example.com
+//	example.com
+//	||example.com^
+//	@@||example.com^
+func parseBlockList(r io.Reader, list *BlockList, block, pass *trie.DomainTrie) int64 {
+	var rules int64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = strings.TrimSpace(line[:idx])
+		}
+		if line == "" || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+
+		// adblock syntax, block the domain and its subdomains
+		if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@||") {
+			allow := line[0] == '@'
+			domain := strings.TrimPrefix(strings.TrimPrefix(line, "@@"), "||")
+			if idx := strings.IndexAny(domain, "^$/"); idx >= 0 {
+				// only pure domain rules make sense to dns
+				if domain[idx] != '^' || idx != len(domain)-1 {
+					continue
+				}
+				domain = domain[:idx]
+			}
+			domain = "+." + strings.ToLower(domain)
+			if allow {
+				_ = pass.Insert(domain, true)
+			} else if block.Insert(domain, list) == nil {
+				rules++
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		// hosts syntax, the first field is an ip
+		if net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, domain := range fields {
+			domain = strings.ToLower(strings.TrimRight(domain, "."))
+			if domain == "localhost" || net.ParseIP(domain) != nil {
+				continue
+			}
+			if block.Insert(domain, list) == nil {
+				rules++
+			}
+		}
+	}
+	return rules
+}
+
+func blockedMsg(mode string, r *dns.Msg) *dns.Msg {
+	msg := r.Copy()
+	q := r.Question[0]
+	switch mode {
+	case BlockModeRefused:
+		msg.SetRcode(r, dns.RcodeRefused)
+	case BlockModeNull:
+		msg.SetRcode(r, dns.RcodeSuccess)
+		switch q.Qtype {
+		case dns.TypeA:
+			rr := &dns.A{}
+			rr.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: dnsDefaultTTL}
+			rr.A = net.IPv4zero
+			msg.Answer = []dns.RR{rr}
+		case dns.TypeAAAA:
+			rr := &dns.AAAA{}
+			rr.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: dnsDefaultTTL}
+			rr.AAAA = net.IPv6zero
+			msg.Answer = []dns.RR{rr}
+		}
+	default:
+		msg.SetRcode(r, dns.RcodeNameError)
+	}
+	msg.RecursionAvailable = true
+	return msg
+}
+
+func ParseBlockMode(mode string) (string, error) {
+	switch strings.ToLower(mode) {
+	case "", BlockModeNXDomain:
+		return BlockModeNXDomain, nil
+	case BlockModeNull, "0.0.0.0":
+		return BlockModeNull, nil
+	case BlockModeRefused:
+		return BlockModeRefused, nil
+	default:
+		return "", fmt.Errorf("unsupport block mode: %s", mode)
+	}
+}
+
+// NewBlocker create the blocker, the lists are loaded once started by the resolver
+func NewBlocker(cfg BlockerConfig) *Blocker {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 24 * time.Hour
+	}
+	b := &Blocker{
+		config:   cfg,
+		mode:     cfg.Mode,
+		interval: cfg.Interval,
+		allow:    cfg.Allow,
+		block:    trie.New(),
+		pass:     trie.New(),
+		refs:     atomic.NewInt32(1),
+		done:     make(chan struct{}),
+	}
+	for _, l := range cfg.Lists {
+		b.lists = append(b.lists, &BlockList{
+			name:      l.Name,
+			source:    l.Source,
+			rules:     atomic.NewInt64(0),
+			hits:      atomic.NewInt64(0),
+			updatedAt: atomic.NewTime(time.Time{}),
+			err:       atomic.NewError(nil),
+		})
+	}
+	return b
+}
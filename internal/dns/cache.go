@@ -0,0 +1,251 @@
+package dns
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/mixed-socks/internal/common/cache"
+	"go.uber.org/atomic"
+	"strings"
+	"time"
+)
+
+// CacheConfig is the caching policy of resolver
+type CacheConfig struct {
+	// MinTTL and MaxTTL clamp the ttl of answers, zero means no clamp
+	MinTTL uint32
+	MaxTTL uint32
+	// StaleWindow is how long an expired answer can be served while refreshing,
+	// zero means serve-stale disabled (RFC 8767)
+	StaleWindow time.Duration
+	// StaleTTL is the ttl of stale answers
+	StaleTTL uint32
+	// Prefetch refresh the entries hit at least PrefetchHits times
+	// before they expire
+	Prefetch     bool
+	PrefetchHits int64
+	// NegativeCache cache NXDOMAIN/NODATA with the SOA minimum (RFC 2308)
+	NegativeCache bool
+}
+
+// CacheEntry is a snapshot of cache entry, for inspection
+type CacheEntry struct {
+	Key      string    `json:"key"`
+	Name     string    `json:"name"`
+	QType    string    `json:"qtype"`
+	Rcode    string    `json:"rcode"`
+	Answers  []string  `json:"answers"`
+	TTL      int64     `json:"ttl"`
+	Expires  time.Time `json:"expires"`
+	Stale    bool      `json:"stale"`
+	Hits     int64     `json:"hits"`
+	Negative bool      `json:"negative"`
+}
+
+type cacheItem struct {
+	msg         *dns.Msg
+	ttl         uint32
+	hits        *atomic.Int64
+	prefetching *atomic.Bool
+}
+
+func newCacheItem(msg *dns.Msg, ttl uint32) *cacheItem {
+	return &cacheItem{
+		msg:         msg,
+		ttl:         ttl,
+		hits:        atomic.NewInt64(0),
+		prefetching: atomic.NewBool(false),
+	}
+}
+
+// cacheKey generate the cache key of query, the answers of different
+// client subnets are never shared
+func cacheKey(ctx context.Context, m *dns.Msg) string {
+	key := m.Question[0].String()
+	subnet := clientSubnetFrom(ctx)
+	if ecs := ecsOption(m); ecs != nil {
+		subnet = truncateSubnet(ecs.Address, int(ecs.SourceNetmask))
+	}
+	if subnet != nil {
+		key += " ecs=" + subnet.String()
+	}
+	// the answer not validated must not be served to the others
+	if m.CheckingDisabled {
+		key += " cd"
+	}
+	return key
+}
+
+// getMsgFromCache return the cached answer, and refresh it in background when
+// the answer is stale or the popular answer is going to expire
+func (r *Resolver) getMsgFromCache(ctx context.Context, m *dns.Msg) (*dns.Msg, bool) {
+	key := cacheKey(ctx, m)
+	c, expireTime, hit := r.lruCache.GetWithExpire(key)
+	if !hit {
+		return nil, false
+	}
+
+	item := c.(*cacheItem)
+	now := time.Now()
+	if expireTime.Before(now) {
+		if r.cacheCfg.StaleWindow <= 0 || now.Sub(expireTime) > r.cacheCfg.StaleWindow {
+			r.lruCache.Delete(key)
+			return nil, false
+		}
+
+		msg := item.msg.Copy()
+		setMsgTTL(msg, r.cacheCfg.StaleTTL)
+		r.refresh(ctx, item, m)
+		return msg, true
+	}
+
+	hits := item.hits.Inc()
+	remaining := time.Until(expireTime)
+	// refresh when less than 10% of the ttl left, like unbound does
+	if r.cacheCfg.Prefetch && hits >= r.cacheCfg.PrefetchHits && remaining*10 < time.Duration(item.ttl)*time.Second {
+		r.refresh(ctx, item, m)
+	}
+
+	msg := item.msg.Copy()
+	setMsgTTL(msg, uint32(remaining.Seconds()))
+	return msg, true
+}
+
+func (r *Resolver) refresh(ctx context.Context, item *cacheItem, m *dns.Msg) {
+	if !item.prefetching.CAS(false, true) {
+		return
+	}
+
+	// keep the client subnet only, the refresh is not a query of the client
+	ctx = contextWithClientSubnet(context.Background(), clientSubnetFrom(ctx))
+	go func() {
+		defer item.prefetching.Store(false)
+		_, err := r.exchangeWithoutCache(ctx, m)
+		if err != nil {
+			logrus.Warnln(err.Error())
+		}
+	}()
+}
+
+func (r *Resolver) putMsgToCache(key string, msg *dns.Msg) {
+	ttl, ok := r.msgTTL(msg)
+	if !ok {
+		logrus.Debugf("[DNS] response msg not cacheable: %s", key)
+		return
+	}
+
+	r.lruCache.SetWithExpire(key, newCacheItem(msg.Copy(), ttl), time.Now().Add(time.Second*time.Duration(ttl)))
+}
+
+// msgTTL return the ttl to cache the msg, and whether the msg is cacheable
+func (r *Resolver) msgTTL(msg *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	switch {
+	case msg.Rcode == dns.RcodeSuccess && len(msg.Answer) != 0:
+		ttl = msg.Answer[0].Header().Ttl
+		for _, rr := range msg.Answer[1:] {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	case msg.Rcode == dns.RcodeSuccess || msg.Rcode == dns.RcodeNameError:
+		// NODATA or NXDOMAIN, cache with the SOA minimum (RFC 2308 section 5)
+		if !r.cacheCfg.NegativeCache {
+			return 0, false
+		}
+		soa := findSOA(msg)
+		if soa == nil {
+			return 0, false
+		}
+		ttl = soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+	default:
+		return 0, false
+	}
+
+	if ttl < r.cacheCfg.MinTTL {
+		ttl = r.cacheCfg.MinTTL
+	}
+	if r.cacheCfg.MaxTTL != 0 && ttl > r.cacheCfg.MaxTTL {
+		ttl = r.cacheCfg.MaxTTL
+	}
+	return ttl, true
+}
+
+// CacheEntries return the snapshot of cache entries, filter by name if not empty
+func (r *Resolver) CacheEntries(name string) []*CacheEntry {
+	name = strings.ToLower(strings.TrimRight(name, "."))
+	now := time.Now()
+
+	entries := []*CacheEntry{}
+	r.lruCache.Range(func(key any, value any, expires time.Time) bool {
+		item := value.(*cacheItem)
+		if len(item.msg.Question) == 0 {
+			return true
+		}
+		q := item.msg.Question[0]
+		qName := strings.ToLower(strings.TrimRight(q.Name, "."))
+		if name != "" && !strings.Contains(qName, name) {
+			return true
+		}
+
+		entry := &CacheEntry{
+			Key:      key.(string),
+			Name:     qName,
+			QType:    dns.TypeToString[q.Qtype],
+			Rcode:    dns.RcodeToString[item.msg.Rcode],
+			TTL:      int64(expires.Sub(now).Seconds()),
+			Expires:  expires,
+			Stale:    expires.Before(now),
+			Hits:     item.hits.Load(),
+			Negative: len(item.msg.Answer) == 0,
+		}
+		for _, rr := range item.msg.Answer {
+			entry.Answers = append(entry.Answers, strings.TrimPrefix(rr.String(), rr.Header().String()))
+		}
+		entries = append(entries, entry)
+		return true
+	})
+	return entries
+}
+
+// FlushCache remove the cache entries, filter by name if not empty,
+// return the count of removed entries
+func (r *Resolver) FlushCache(name string) int {
+	name = strings.ToLower(strings.TrimRight(name, "."))
+
+	var keys []any
+	r.lruCache.Range(func(key any, value any, _ time.Time) bool {
+		item := value.(*cacheItem)
+		if name != "" {
+			if len(item.msg.Question) == 0 {
+				return true
+			}
+			if !strings.EqualFold(strings.TrimRight(item.msg.Question[0].Name, "."), name) {
+				return true
+			}
+		}
+		keys = append(keys, key)
+		return true
+	})
+
+	for _, key := range keys {
+		r.lruCache.Delete(key)
+	}
+	return len(keys)
+}
+
+func findSOA(msg *dns.Msg) *dns.SOA {
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+	return nil
+}
+
+func newCache() *cache.LruCache {
+	return cache.New(cache.WithSize(65535), cache.WithStale(true))
+}
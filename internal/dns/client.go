@@ -14,10 +14,17 @@ import (
 
 type client struct {
 	*dns.Client
-	r     *Resolver
-	port  string
-	host  string
-	iface string
+	r            *Resolver
+	addr         string
+	port         string
+	host         string
+	iface        string
+	proxyAdapter string
+}
+
+// Address implements dnsClient
+func (c *client) Address() string {
+	return c.addr
 }
 
 func (c *client) Exchange(m *dns.Msg) (*dns.Msg, error) {
@@ -29,7 +36,10 @@ func (c *client) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, err
 		ip  net.IP
 		err error
 	)
-	if c.r == nil {
+	if c.proxyAdapter != "" {
+		// the proxy resolve the upstream, avoid leaking it to local dns
+		ip = net.ParseIP(c.host)
+	} else if c.r == nil {
 		// a default ip dns
 		if ip = net.ParseIP(c.host); ip == nil {
 			return nil, fmt.Errorf("dns %s not a valid ip", c.host)
@@ -53,7 +63,7 @@ func (c *client) ExchangeContext(ctx context.Context, m *dns.Msg) (*dns.Msg, err
 	if c.iface != "" {
 		options = append(options, dialer.WithInterface(c.iface))
 	}
-	conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), c.port), options...)
+	conn, err := dialContextExtra(ctx, c.proxyAdapter, network, c.host, ip, c.port, options...)
 	if err != nil {
 		return nil, err
 	}
@@ -31,6 +31,11 @@ type dhcpClient struct {
 	err       error
 }
 
+// Address implements dnsClient
+func (d *dhcpClient) Address() string {
+	return "dhcp://" + d.ifaceName
+}
+
 func (d *dhcpClient) Exchange(m *dns.Msg) (msg *dns.Msg, err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), resolver.DefaultDNSTimeout)
 	defer cancel()
@@ -0,0 +1,69 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"github.com/xmapst/mixed-socks/internal/component/resolver"
+	"github.com/xmapst/mixed-socks/internal/context"
+	"net"
+)
+
+// withDNS64 synthesize the AAAA records from the A records within the prefix,
+// when the name has no AAAA record (RFC 6147)
+func withDNS64(prefix *net.IPNet) middleware {
+	return func(next handler) handler {
+		return func(ctx *context.DNSContext, r *dns.Msg) (*dns.Msg, error) {
+			q := r.Question[0]
+			if q.Qtype != dns.TypeAAAA || q.Qclass != dns.ClassINET {
+				return next(ctx, r)
+			}
+
+			msg, err := next(ctx, r)
+			if err != nil || msg.Rcode != dns.RcodeSuccess || hasAAAA(msg) {
+				return msg, err
+			}
+
+			req := r.Copy()
+			req.Question[0].Qtype = dns.TypeA
+			aMsg, err := next(ctx, req)
+			if err != nil || aMsg.Rcode != dns.RcodeSuccess {
+				return msg, nil
+			}
+
+			var answer []dns.RR
+			synthesized := false
+			for _, rr := range aMsg.Answer {
+				switch a := rr.(type) {
+				case *dns.A:
+					if a.A.IsLoopback() || a.A.IsUnspecified() {
+						continue
+					}
+					answer = append(answer, &dns.AAAA{
+						Hdr:  dns.RR_Header{Name: a.Hdr.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: a.Hdr.Ttl},
+						AAAA: resolver.SynthesizeIPv6(prefix, a.A),
+					})
+					synthesized = true
+				case *dns.CNAME:
+					answer = append(answer, rr)
+				}
+			}
+			if !synthesized {
+				return msg, nil
+			}
+
+			msg.Answer = answer
+			msg.Ns = nil
+			// the synthesized records never validate
+			msg.AuthenticatedData = false
+			return msg, nil
+		}
+	}
+}
+
+func hasAAAA(msg *dns.Msg) bool {
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			return true
+		}
+	}
+	return false
+}
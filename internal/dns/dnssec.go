@@ -0,0 +1,597 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/mixed-socks/internal/common/cache"
+	"github.com/xmapst/mixed-socks/internal/component/trie"
+	"strings"
+	"time"
+)
+
+// RootTrustAnchor is the DS of root KSK-2017
+const RootTrustAnchor = ". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+
+const (
+	dnssecKeyCacheSize     = 4096
+	dnssecMaxKeyTTL        = time.Hour
+	dnssecQueryTimeout     = 5 * time.Second
+	dnssecQueryCachePrefix = "dnssec "
+)
+
+var ErrDNSSECBogus = errors.New("dnssec validation failed")
+
+// DNSSECConfig is the validation config of resolver
+type DNSSECConfig struct {
+	// TrustAnchors are DS or DNSKEY records, the root KSK if empty
+	TrustAnchors []dns.RR
+	// NegativeTrustAnchors are domains not to validate, the subdomains included
+	NegativeTrustAnchors []string
+}
+
+type dnssecResult int
+
+const (
+	dnssecInsecure dnssecResult = iota
+	dnssecSecure
+	dnssecBogus
+)
+
+type rrsetKey struct {
+	name  string
+	rtype uint16
+}
+
+type zoneKeys struct {
+	keys   []*dns.DNSKEY
+	result dnssecResult
+}
+
+type dnssecValidator struct {
+	r       *Resolver
+	anchors map[string][]dns.RR
+	nta     *trie.DomainTrie
+	keys    *cache.LruCache
+}
+
+// validate validate the response of upstream, return whether the answer is secure.
+// An error is returned when the answer is bogus.
+func (v *dnssecValidator) validate(ctx context.Context, msg *dns.Msg) (bool, error) {
+	if len(msg.Question) == 0 {
+		return false, nil
+	}
+	q := msg.Question[0]
+	if v.isNegativeTrustAnchor(q.Name) {
+		return false, nil
+	}
+
+	// the proofs are about the last name of the CNAME chain
+	target, answered := answerTarget(msg, q)
+	negative := msg.Rcode == dns.RcodeNameError || !answered
+
+	answerSets, answerSigs := splitRRsets(msg.Answer)
+	nsSets, nsSigs := splitRRsets(msg.Ns)
+	if len(answerSets) == 0 && len(nsSets) == 0 {
+		if v.unsignedResult(ctx, target) == dnssecBogus {
+			return false, fmt.Errorf("%w: %s unsigned denial", ErrDNSSECBogus, target)
+		}
+		return false, nil
+	}
+
+	result := dnssecSecure
+	proofs := &denial{}
+	expanded := map[string]int{}
+	check := func(key rrsetKey, set []dns.RR, covered []*dns.RRSIG) error {
+		var res dnssecResult
+		var sig *dns.RRSIG
+		if len(covered) == 0 {
+			res = v.unsignedResult(ctx, key.name)
+		} else {
+			res, sig = v.verifyRRset(ctx, set, covered)
+		}
+
+		switch res {
+		case dnssecBogus:
+			return fmt.Errorf("%w: %s %s", ErrDNSSECBogus, key.name, dns.TypeToString[key.rtype])
+		case dnssecInsecure:
+			result = dnssecInsecure
+		case dnssecSecure:
+			// the answer expanded from wildcard, must prove the name not exist
+			if int(sig.Labels) < signedLabels(key.name) {
+				expanded[key.name] = int(sig.Labels)
+			}
+			proofs.add(set, sig.SignerName)
+		}
+		return nil
+	}
+
+	for key, set := range answerSets {
+		// the CNAME synthesized from DNAME is not signed (RFC 6672 section 5.3.1)
+		if key.rtype == dns.TypeCNAME && len(answerSigs[key]) == 0 && synthesized(key.name, answerSets) {
+			continue
+		}
+		if err := check(key, set, answerSigs[key]); err != nil {
+			return false, err
+		}
+	}
+	for key, set := range nsSets {
+		// the positive answer only needs the wildcard proofs in authority section
+		if !negative && key.rtype != dns.TypeNSEC && key.rtype != dns.TypeNSEC3 {
+			continue
+		}
+		if err := check(key, set, nsSigs[key]); err != nil {
+			return false, err
+		}
+	}
+	if result != dnssecSecure {
+		return false, nil
+	}
+
+	for name, labels := range expanded {
+		if !proofs.wildcardExpanded(name, labels) {
+			return false, fmt.Errorf("%w: %s wildcard expansion not proven", ErrDNSSECBogus, name)
+		}
+	}
+	if negative {
+		var proven bool
+		if msg.Rcode == dns.RcodeNameError {
+			proven = proofs.nxDomain(target)
+		} else {
+			proven = proofs.noData(target, q.Qtype)
+		}
+		if !proven {
+			return false, fmt.Errorf("%w: %s denial of existence not proven", ErrDNSSECBogus, target)
+		}
+	}
+	return true, nil
+}
+
+// answerTarget follow the CNAME chain in answer, return the last name
+// and whether the records of the question type are found
+func answerTarget(msg *dns.Msg, q dns.Question) (string, bool) {
+	name := dns.CanonicalName(q.Name)
+	for i := 0; i <= len(msg.Answer); i++ {
+		var next string
+		for _, rr := range msg.Answer {
+			if dns.CanonicalName(rr.Header().Name) != name {
+				continue
+			}
+			if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+				return name, true
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = dns.CanonicalName(cname.Target)
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+	return name, false
+}
+
+// synthesized return whether a DNAME in answer is the ancestor of the name
+func synthesized(name string, sets map[rrsetKey][]dns.RR) bool {
+	for key := range sets {
+		if key.rtype == dns.TypeDNAME && key.name != name && dns.IsSubDomain(key.name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// unsignedResult decide an unsigned rrset is bogus or insecure,
+// it's bogus if the zone it belongs to is signed
+func (v *dnssecValidator) unsignedResult(ctx context.Context, name string) dnssecResult {
+	zone, err := v.findZone(ctx, name)
+	if err != nil {
+		return dnssecBogus
+	}
+	if _, res := v.zoneKeys(ctx, zone, 0); res == dnssecSecure {
+		return dnssecBogus
+	}
+	return dnssecInsecure
+}
+
+// verifyRRset verify the rrset with one of the signatures, the signer keys must be trusted,
+// return the signature verified it
+func (v *dnssecValidator) verifyRRset(ctx context.Context, set []dns.RR, sigs []*dns.RRSIG) (dnssecResult, *dns.RRSIG) {
+	result := dnssecBogus
+	name := set[0].Header().Name
+	for _, sig := range sigs {
+		if !dns.IsSubDomain(sig.SignerName, name) || int(sig.Labels) > signedLabels(name) {
+			continue
+		}
+		keys, res := v.zoneKeys(ctx, sig.SignerName, 0)
+		if res != dnssecSecure {
+			if res == dnssecInsecure {
+				result = dnssecInsecure
+			}
+			continue
+		}
+		if verifyWithKeys(sig, keys, set) {
+			return dnssecSecure, sig
+		}
+	}
+	return result, nil
+}
+
+// zoneKeys return the trusted DNSKEY of zone, follow the chain of trust to the anchors
+func (v *dnssecValidator) zoneKeys(ctx context.Context, zone string, depth int) ([]*dns.DNSKEY, dnssecResult) {
+	zone = dns.CanonicalName(zone)
+	if cached, ok := v.keys.Get(zone); ok {
+		entry := cached.(*zoneKeys)
+		return entry.keys, entry.result
+	}
+	if depth > dns.CountLabel(zone)+1 {
+		return nil, dnssecBogus
+	}
+
+	keys, result, ttl := v.fetchZoneKeys(ctx, zone, depth)
+	if ttl > dnssecMaxKeyTTL || ttl <= 0 {
+		ttl = dnssecMaxKeyTTL
+	}
+	// never cache the bogus result for long, it may be a transient failure
+	if result == dnssecBogus {
+		ttl = time.Minute
+	}
+	v.keys.SetWithExpire(zone, &zoneKeys{keys: keys, result: result}, time.Now().Add(ttl))
+	return keys, result
+}
+
+func (v *dnssecValidator) fetchZoneKeys(ctx context.Context, zone string, depth int) ([]*dns.DNSKEY, dnssecResult, time.Duration) {
+	// the DS which the DNSKEY must match
+	dsSet, anchored := v.anchors[zone]
+	if !anchored {
+		if zone == "." {
+			// no anchor for root, nothing could be secure
+			return nil, dnssecInsecure, 0
+		}
+		var res dnssecResult
+		dsSet, res = v.delegation(ctx, zone, depth)
+		if res != dnssecSecure {
+			return nil, res, 0
+		}
+	}
+
+	resp, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, dnssecBogus, 0
+	}
+
+	keySet, sigs := splitRRsets(resp.Answer)
+	key := rrsetKey{name: zone, rtype: dns.TypeDNSKEY}
+	set := keySet[key]
+	if len(set) == 0 {
+		return nil, dnssecBogus, 0
+	}
+
+	var keys []*dns.DNSKEY
+	for _, rr := range set {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+
+	// the secure entry points are the keys match the DS or the DNSKEY anchors
+	var entries []*dns.DNSKEY
+	supported := false
+	for _, anchor := range dsSet {
+		for _, k := range keys {
+			if matchAnchor(anchor, k) {
+				entries = append(entries, k)
+			}
+		}
+		if ds, ok := anchor.(*dns.DS); !ok || isSupportedAlgorithm(ds.Algorithm) {
+			supported = true
+		}
+	}
+	if !supported {
+		// unknown algorithms, treat the zone as insecure (RFC 4035 section 5.2)
+		return nil, dnssecInsecure, 0
+	}
+
+	for _, sig := range sigs[key] {
+		if verifyWithKeys(sig, entries, set) {
+			return keys, dnssecSecure, time.Duration(set[0].Header().Ttl) * time.Second
+		}
+	}
+	return nil, dnssecBogus, 0
+}
+
+// delegation return the trusted DS of zone, or insecure if the absence of DS is proven
+func (v *dnssecValidator) delegation(ctx context.Context, zone string, depth int) ([]dns.RR, dnssecResult) {
+	resp, err := v.query(zone, dns.TypeDS)
+	if err != nil {
+		return nil, dnssecBogus
+	}
+
+	if resp.Rcode == dns.RcodeSuccess && len(resp.Answer) != 0 {
+		sets, sigs := splitRRsets(resp.Answer)
+		key := rrsetKey{name: zone, rtype: dns.TypeDS}
+		set := sets[key]
+		if len(set) == 0 {
+			return nil, dnssecBogus
+		}
+		for _, sig := range sigs[key] {
+			parentKeys, res := v.zoneKeys(ctx, sig.SignerName, depth+1)
+			if res != dnssecSecure {
+				return nil, res
+			}
+			if verifyWithKeys(sig, parentKeys, set) {
+				return set, dnssecSecure
+			}
+		}
+		return nil, dnssecBogus
+	}
+
+	// no DS, the zone is insecure if the parent proves it with signed NSEC/NSEC3,
+	// or the parent is insecure itself
+	sets, sigs := splitRRsets(resp.Ns)
+	proofs := &denial{}
+	var signer string
+	for key, set := range sets {
+		covered := sigs[key]
+		if len(covered) == 0 {
+			continue
+		}
+		signer = covered[0].SignerName
+		parentKeys, res := v.zoneKeys(ctx, signer, depth+1)
+		if res != dnssecSecure {
+			return nil, res
+		}
+		verified := false
+		for _, sig := range covered {
+			if verifyWithKeys(sig, parentKeys, set) {
+				verified = true
+				proofs.add(set, sig.SignerName)
+				break
+			}
+		}
+		if !verified {
+			return nil, dnssecBogus
+		}
+	}
+	if signer == "" {
+		// nothing signed, bogus if the parent is signed
+		parent, err := v.findZone(ctx, parentName(zone))
+		if err != nil {
+			return nil, dnssecBogus
+		}
+		if _, res := v.zoneKeys(ctx, parent, depth+1); res == dnssecSecure {
+			return nil, dnssecBogus
+		}
+		return nil, dnssecInsecure
+	}
+
+	if proofs.noData(zone, dns.TypeDS) || resp.Rcode == dns.RcodeNameError && proofs.nxDomain(zone) {
+		return nil, dnssecInsecure
+	}
+	return nil, dnssecBogus
+}
+
+// findZone find the zone the name belongs to by the SOA record
+func (v *dnssecValidator) findZone(ctx context.Context, name string) (string, error) {
+	resp, err := v.query(name, dns.TypeSOA)
+	if err != nil {
+		return "", err
+	}
+	for _, rr := range append(resp.Answer, resp.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok && dns.IsSubDomain(soa.Hdr.Name, name) {
+			return soa.Hdr.Name, nil
+		}
+	}
+	return "", fmt.Errorf("zone of %s not found", name)
+}
+
+// query lookup the DNSKEY, DS or SOA for validation, it is cached and never
+// recorded as the query of client
+func (v *dnssecValidator) query(name string, qtype uint16) (*dns.Msg, error) {
+	m := &dns.Msg{}
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	key := dnssecQueryCachePrefix + m.Question[0].String()
+	if cached, expireTime, hit := v.r.lruCache.GetWithExpire(key); hit && expireTime.After(time.Now()) {
+		return cached.(*cacheItem).msg.Copy(), nil
+	}
+
+	ret, err, shared := v.r.group.Do(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), dnssecQueryTimeout)
+		defer cancel()
+		msg, err := v.r.batchExchange(ctx, v.r.main, withDNSSECOK(m))
+		if err != nil {
+			return nil, err
+		}
+		v.r.putMsgToCache(key, msg)
+		return msg, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	msg := ret.(*dns.Msg)
+	if shared {
+		msg = msg.Copy()
+	}
+	return msg, nil
+}
+
+// isNegativeTrustAnchor return whether the name or one of its ancestors is
+// a negative trust anchor (RFC 7646 section 2.1)
+func (v *dnssecValidator) isNegativeTrustAnchor(name string) bool {
+	name = strings.TrimRight(strings.ToLower(name), ".")
+	for name != "" {
+		if v.nta.Search(name) != nil {
+			return true
+		}
+		idx := strings.IndexByte(name, '.')
+		if idx < 0 {
+			break
+		}
+		name = name[idx+1:]
+	}
+	return false
+}
+
+// withDNSSECOK return a copy of msg request the DNSSEC records,
+// and disable the checking of upstream since the validation is done here
+func withDNSSECOK(m *dns.Msg) *dns.Msg {
+	m = m.Copy()
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		m.SetEdns0(4096, true)
+	}
+	m.CheckingDisabled = true
+	return m
+}
+
+// stripDNSSEC remove the DNSSEC records and the DO bit for the client not request them
+// (RFC 4035 section 3.2.1), the AD bit is kept only when the client asks for it (RFC 6840 section 5.8)
+func stripDNSSEC(msg *dns.Msg, r *dns.Msg) {
+	reqOpt := r.IsEdns0()
+	if reqOpt != nil && reqOpt.Do() {
+		return
+	}
+	if !r.AuthenticatedData {
+		msg.AuthenticatedData = false
+	}
+
+	qtype := r.Question[0].Qtype
+	filter := func(rrs []dns.RR) []dns.RR {
+		ret := rrs[:0]
+		for _, rr := range rrs {
+			switch rr.Header().Rrtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if rr.Header().Rrtype != qtype {
+					continue
+				}
+			case dns.TypeOPT:
+				if reqOpt == nil {
+					continue
+				}
+				opt := rr.(*dns.OPT)
+				opt.SetDo(false)
+			}
+			ret = append(ret, rr)
+		}
+		return ret
+	}
+	msg.Answer = filter(msg.Answer)
+	msg.Ns = filter(msg.Ns)
+	msg.Extra = filter(msg.Extra)
+}
+
+func splitRRsets(rrs []dns.RR) (map[rrsetKey][]dns.RR, map[rrsetKey][]*dns.RRSIG) {
+	sets := map[rrsetKey][]dns.RR{}
+	sigs := map[rrsetKey][]*dns.RRSIG{}
+	for _, rr := range rrs {
+		name := dns.CanonicalName(rr.Header().Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetKey{name: name, rtype: sig.TypeCovered}
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := rrsetKey{name: name, rtype: rr.Header().Rrtype}
+		sets[key] = append(sets[key], rr)
+	}
+	return sets, sigs
+}
+
+func verifyWithKeys(sig *dns.RRSIG, keys []*dns.DNSKEY, set []dns.RR) bool {
+	if !sig.ValidityPeriod(time.Now()) {
+		return false
+	}
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if !dns.IsSubDomain(key.Hdr.Name, sig.SignerName) || !dns.IsSubDomain(sig.SignerName, key.Hdr.Name) {
+			continue
+		}
+		if sig.Verify(key, set) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAnchor(anchor dns.RR, key *dns.DNSKEY) bool {
+	switch a := anchor.(type) {
+	case *dns.DS:
+		if a.KeyTag != key.KeyTag() || a.Algorithm != key.Algorithm {
+			return false
+		}
+		ds := key.ToDS(a.DigestType)
+		return ds != nil && strings.EqualFold(ds.Digest, a.Digest)
+	case *dns.DNSKEY:
+		return a.Flags == key.Flags && a.Protocol == key.Protocol &&
+			a.Algorithm == key.Algorithm && a.PublicKey == key.PublicKey
+	default:
+		return false
+	}
+}
+
+func isSupportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+		dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	default:
+		return false
+	}
+}
+
+func parentName(name string) string {
+	idx, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[idx:]
+}
+
+// ParseTrustAnchors parse the DS or DNSKEY records in presentation format
+func ParseTrustAnchors(anchors []string) ([]dns.RR, error) {
+	var rrs []dns.RR
+	for _, anchor := range anchors {
+		rr, err := dns.NewRR(anchor)
+		if err != nil {
+			return nil, fmt.Errorf("trust anchor %s: %w", anchor, err)
+		}
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+		default:
+			return nil, fmt.Errorf("trust anchor %s: must be DS or DNSKEY", anchor)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+func newDNSSECValidator(r *Resolver, cfg *DNSSECConfig) *dnssecValidator {
+	v := &dnssecValidator{
+		r:       r,
+		anchors: map[string][]dns.RR{},
+		nta:     trie.New(),
+		keys:    cache.New(cache.WithSize(dnssecKeyCacheSize)),
+	}
+
+	anchors := cfg.TrustAnchors
+	if len(anchors) == 0 {
+		anchors, _ = ParseTrustAnchors([]string{RootTrustAnchor})
+	}
+	for _, rr := range anchors {
+		zone := dns.CanonicalName(rr.Header().Name)
+		v.anchors[zone] = append(v.anchors[zone], rr)
+	}
+
+	for _, domain := range cfg.NegativeTrustAnchors {
+		if err := v.nta.Insert(strings.ToLower(domain), true); err != nil {
+			logrus.Warnf("[DNS] negative trust anchor %s: %s", domain, err)
+		}
+	}
+	return v
+}
@@ -0,0 +1,325 @@
+package dns
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is a signed zone "example." served by a local upstream:
+//
+//	example.      SOA NS DNSKEY
+//	a.example.    A
+//	c.example.    A
+//	*.w.example.  A
+type testZone struct {
+	t      *testing.T
+	key    *dns.DNSKEY
+	signer crypto.Signer
+	// answers override the response of "name type"
+	answers map[string]*dns.Msg
+}
+
+func newTestZone(t *testing.T) *testZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testZone{t: t, key: key, signer: priv.(crypto.Signer), answers: map[string]*dns.Msg{}}
+}
+
+func (z *testZone) rr(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		z.t.Fatal(err)
+	}
+	return rr
+}
+
+// sign return the rrset with its signature
+func (z *testZone) sign(rrs ...dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrs[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrs[0].Header().Ttl},
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.key.Hdr.Name,
+		Algorithm:  z.key.Algorithm,
+	}
+	if err := sig.Sign(z.signer, rrs); err != nil {
+		z.t.Fatal(err)
+	}
+	return append(rrs, sig)
+}
+
+func (z *testZone) soa() []dns.RR {
+	return z.sign(z.rr("example. 3600 IN SOA ns.example. admin.example. 1 3600 600 86400 300"))
+}
+
+// nsec3Chain return the signed NSEC3 chain of the names in zone
+func (z *testZone) nsec3Chain(names map[string][]uint16) []dns.RR {
+	type entry struct {
+		hash  string
+		types []uint16
+	}
+	var entries []entry
+	for name, types := range names {
+		entries = append(entries, entry{hash: dns.HashName(name, dns.SHA1, 0, ""), types: types})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].hash < entries[j].hash })
+
+	var rrs []dns.RR
+	for i, e := range entries {
+		nsec3 := &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(e.hash) + ".example.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Iterations: 0,
+			SaltLength: 0,
+			NextDomain: entries[(i+1)%len(entries)].hash,
+			HashLength: 20,
+			TypeBitMap: e.types,
+		}
+		rrs = append(rrs, z.sign(nsec3)...)
+	}
+	return rrs
+}
+
+func (z *testZone) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	msg, ok := z.answers[dns.CanonicalName(q.Name)+" "+dns.TypeToString[q.Qtype]]
+	switch {
+	case ok:
+		msg = msg.Copy()
+	case q.Qtype == dns.TypeDNSKEY && dns.CanonicalName(q.Name) == "example.":
+		msg = &dns.Msg{Answer: z.sign(dns.Copy(z.key))}
+	case q.Qtype == dns.TypeSOA && dns.CanonicalName(q.Name) == "example.":
+		msg = &dns.Msg{Answer: z.soa()}
+	default:
+		msg = &dns.Msg{Ns: z.soa()}
+	}
+	rcode := msg.Rcode
+	msg.SetReply(r)
+	msg.Rcode = rcode
+	_ = w.WriteMsg(msg)
+}
+
+func (z *testZone) serve() string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		z.t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: z}
+	go func() { _ = server.ActivateAndServe() }()
+	z.t.Cleanup(func() { _ = server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+func (z *testZone) exchange(name string, qtype uint16, nta []string, cd bool) (*dns.Msg, error) {
+	r := NewResolver(Config{
+		NameServers: []NameServer{{Net: "udp", Addr: z.serve()}},
+		DNSSEC: &DNSSECConfig{
+			TrustAnchors:         []dns.RR{z.key},
+			NegativeTrustAnchors: nta,
+		},
+	})
+	defer r.Close()
+
+	m := &dns.Msg{}
+	m.SetQuestion(name, qtype)
+	m.CheckingDisabled = cd
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return r.ExchangeContext(ctx, m)
+}
+
+func TestDNSSECValidation(t *testing.T) {
+	cases := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		nta    []string
+		cd     bool
+		build  func(z *testZone) *dns.Msg
+		secure bool
+		bogus  bool
+	}{
+		{
+			name:  "secure",
+			qname: "a.example.", qtype: dns.TypeA,
+			build: func(z *testZone) *dns.Msg {
+				return &dns.Msg{Answer: z.sign(z.rr("a.example. 300 IN A 192.0.2.1"))}
+			},
+			secure: true,
+		},
+		{
+			name:  "bad signature",
+			qname: "a.example.", qtype: dns.TypeA,
+			build: func(z *testZone) *dns.Msg {
+				rrs := z.sign(z.rr("a.example. 300 IN A 192.0.2.1"))
+				rrs[0].(*dns.A).A = net.ParseIP("192.0.2.9")
+				return &dns.Msg{Answer: rrs}
+			},
+			bogus: true,
+		},
+		{
+			name:  "unsigned in signed zone",
+			qname: "a.example.", qtype: dns.TypeA,
+			build: func(z *testZone) *dns.Msg {
+				return &dns.Msg{Answer: []dns.RR{z.rr("a.example. 300 IN A 192.0.2.1")}}
+			},
+			bogus: true,
+		},
+		{
+			name:  "nxdomain",
+			qname: "b.example.", qtype: dns.TypeA,
+			build: func(z *testZone) *dns.Msg {
+				ns := append(z.soa(), z.sign(z.rr("a.example. 300 IN NSEC c.example. A RRSIG NSEC"))...)
+				ns = append(ns, z.sign(z.rr("example. 300 IN NSEC a.example. NS SOA RRSIG NSEC DNSKEY"))...)
+				return &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}, Ns: ns}
+			},
+			secure: true,
+		},
+		{
+			name:  "nxdomain without wildcard proof",
+			qname: "b.example.", qtype: dns.TypeA,
+			build: func(z *testZone) *dns.Msg {
+				ns := append(z.soa(), z.sign(z.rr("a.example. 300 IN NSEC c.example. A RRSIG NSEC"))...)
+				return &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}, Ns: ns}
+			},
+			bogus: true,
+		},
+		{
+			name:  "forged nxdomain with unrelated nsec",
+			qname: "a.example.", qtype: dns.TypeA,
+			build: func(z *testZone) *dns.Msg {
+				ns := append(z.soa(), z.sign(z.rr("c.example. 300 IN NSEC *.w.example. A RRSIG NSEC"))...)
+				ns = append(ns, z.sign(z.rr("example. 300 IN NSEC a.example. NS SOA RRSIG NSEC DNSKEY"))...)
+				return &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}, Ns: ns}
+			},
+			bogus: true,
+		},
+		{
+			name:  "nodata",
+			qname: "a.example.", qtype: dns.TypeAAAA,
+			build: func(z *testZone) *dns.Msg {
+				ns := append(z.soa(), z.sign(z.rr("a.example. 300 IN NSEC c.example. A RRSIG NSEC"))...)
+				return &dns.Msg{Ns: ns}
+			},
+			secure: true,
+		},
+		{
+			name:  "forged nodata of existing type",
+			qname: "a.example.", qtype: dns.TypeA,
+			build: func(z *testZone) *dns.Msg {
+				ns := append(z.soa(), z.sign(z.rr("a.example. 300 IN NSEC c.example. A RRSIG NSEC"))...)
+				return &dns.Msg{Ns: ns}
+			},
+			bogus: true,
+		},
+		{
+			name:  "wildcard expansion",
+			qname: "x.w.example.", qtype: dns.TypeA,
+			build: func(z *testZone) *dns.Msg {
+				answer := z.sign(z.rr("*.w.example. 300 IN A 192.0.2.4"))
+				for _, rr := range answer {
+					rr.Header().Name = "x.w.example."
+				}
+				ns := z.sign(z.rr("*.w.example. 300 IN NSEC example. A RRSIG NSEC"))
+				return &dns.Msg{Answer: answer, Ns: ns}
+			},
+			secure: true,
+		},
+		{
+			name:  "wildcard expansion without proof",
+			qname: "x.w.example.", qtype: dns.TypeA,
+			build: func(z *testZone) *dns.Msg {
+				answer := z.sign(z.rr("*.w.example. 300 IN A 192.0.2.4"))
+				for _, rr := range answer {
+					rr.Header().Name = "x.w.example."
+				}
+				return &dns.Msg{Answer: answer}
+			},
+			bogus: true,
+		},
+		{
+			name:  "nsec3 nxdomain",
+			qname: "b.example.", qtype: dns.TypeA,
+			build: func(z *testZone) *dns.Msg {
+				ns := append(z.soa(), z.nsec3Chain(map[string][]uint16{
+					"example.":     {dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM},
+					"a.example.":   {dns.TypeA, dns.TypeRRSIG},
+					"c.example.":   {dns.TypeA, dns.TypeRRSIG},
+					"w.example.":   nil,
+					"*.w.example.": {dns.TypeA, dns.TypeRRSIG},
+				})...)
+				return &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}, Ns: ns}
+			},
+			secure: true,
+		},
+		{
+			name:  "negative trust anchor",
+			qname: "a.example.", qtype: dns.TypeA,
+			nta: []string{"example"},
+			build: func(z *testZone) *dns.Msg {
+				rrs := z.sign(z.rr("a.example. 300 IN A 192.0.2.1"))
+				rrs[0].(*dns.A).A = net.ParseIP("192.0.2.9")
+				return &dns.Msg{Answer: rrs}
+			},
+		},
+		{
+			name:  "negative trust anchor of other domain",
+			qname: "a.example.", qtype: dns.TypeA,
+			nta: []string{"b.example"},
+			build: func(z *testZone) *dns.Msg {
+				rrs := z.sign(z.rr("a.example. 300 IN A 192.0.2.1"))
+				rrs[0].(*dns.A).A = net.ParseIP("192.0.2.9")
+				return &dns.Msg{Answer: rrs}
+			},
+			bogus: true,
+		},
+		{
+			name:  "checking disabled",
+			qname: "a.example.", qtype: dns.TypeA,
+			cd: true,
+			build: func(z *testZone) *dns.Msg {
+				rrs := z.sign(z.rr("a.example. 300 IN A 192.0.2.1"))
+				rrs[0].(*dns.A).A = net.ParseIP("192.0.2.9")
+				return &dns.Msg{Answer: rrs}
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			z := newTestZone(t)
+			z.answers[c.qname+" "+dns.TypeToString[c.qtype]] = c.build(z)
+
+			msg, err := z.exchange(c.qname, c.qtype, c.nta, c.cd)
+			if c.bogus {
+				if !errors.Is(err, ErrDNSSECBogus) {
+					t.Fatalf("expect bogus, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if msg.AuthenticatedData != c.secure {
+				t.Fatalf("expect AD %v, got %v", c.secure, msg.AuthenticatedData)
+			}
+		})
+	}
+}
@@ -24,6 +24,11 @@ type dohClient struct {
 	transport *http.Transport
 }
 
+// Address implements dnsClient
+func (dc *dohClient) Address() string {
+	return dc.url
+}
+
 func (dc *dohClient) Exchange(m *dns.Msg) (msg *dns.Msg, err error) {
 	return dc.ExchangeContext(context.Background(), m)
 }
@@ -82,7 +87,7 @@ func (dc *dohClient) doRequest(req *http.Request) (msg *dns.Msg, err error) {
 	return msg, err
 }
 
-func newDoHClient(url, iface string, r *Resolver) *dohClient {
+func newDoHClient(url, iface, proxyAdapter string, r *Resolver) *dohClient {
 	return &dohClient{
 		url: url,
 		transport: &http.Transport{
@@ -92,6 +97,17 @@ func newDoHClient(url, iface string, r *Resolver) *dohClient {
 				if err != nil {
 					return nil, err
 				}
+
+				var options []dialer.Option
+				if iface != "" {
+					options = append(options, dialer.WithInterface(iface))
+				}
+
+				if proxyAdapter != "" {
+					// the proxy resolve the upstream, avoid leaking it to local dns
+					return dialContextExtra(ctx, proxyAdapter, "tcp", host, net.ParseIP(host), port, options...)
+				}
+
 				ips, err := resolver.LookupIPWithResolver(ctx, host, r)
 				if err != nil {
 					return nil, err
@@ -100,11 +116,6 @@ func newDoHClient(url, iface string, r *Resolver) *dohClient {
 				}
 				ip := ips[rand.Intn(len(ips))]
 
-				var options []dialer.Option
-				if iface != "" {
-					options = append(options, dialer.WithInterface(iface))
-				}
-
 				return dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port), options...)
 			},
 			TLSClientConfig: &tls.Config{
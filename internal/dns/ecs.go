@@ -0,0 +1,163 @@
+package dns
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+)
+
+const (
+	DefaultECSIPv4Prefix = 24
+	DefaultECSIPv6Prefix = 56
+)
+
+// ECSConfig is the EDNS Client Subnet config of nameserver (RFC 7871)
+type ECSConfig struct {
+	// Subnet is the fixed subnet sent to upstream, nil means the subnet of client
+	Subnet *net.IPNet
+	// IPv4Prefix and IPv6Prefix truncate the address of client
+	IPv4Prefix int
+	IPv6Prefix int
+}
+
+// ecsClient add the client subnet to the queries of the wrapped client
+type ecsClient struct {
+	dnsClient
+	ecs *ECSConfig
+}
+
+func (c *ecsClient) Exchange(m *dns.Msg) (msg *dns.Msg, err error) {
+	return c.ExchangeContext(context.Background(), m)
+}
+
+func (c *ecsClient) ExchangeContext(ctx context.Context, m *dns.Msg) (msg *dns.Msg, err error) {
+	subnet := c.ecs.Subnet
+	if subnet == nil {
+		source := clientSubnetFrom(ctx)
+		if opt := ecsOption(m); opt != nil {
+			source = truncateSubnet(opt.Address, int(opt.SourceNetmask))
+		}
+		if source == nil {
+			// no client subnet known, e.g. the lookup of the proxy itself
+			return c.dnsClient.ExchangeContext(ctx, m)
+		}
+		prefix := c.ecs.IPv4Prefix
+		if source.IP.To4() == nil {
+			prefix = c.ecs.IPv6Prefix
+		}
+		if ones, _ := source.Mask.Size(); ones < prefix {
+			prefix = ones
+		}
+		subnet = truncateSubnet(source.IP, prefix)
+	}
+
+	m = m.Copy()
+	setECS(m, subnet)
+	return c.dnsClient.ExchangeContext(ctx, m)
+}
+
+// clientSubnetKey is the context key of the client subnet, only the
+// nameservers with ECS enabled send it to upstream
+type clientSubnetKey struct{}
+
+func contextWithClientSubnet(ctx context.Context, subnet *net.IPNet) context.Context {
+	if subnet == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, clientSubnetKey{}, subnet)
+}
+
+func clientSubnetFrom(ctx context.Context) *net.IPNet {
+	subnet, _ := ctx.Value(clientSubnetKey{}).(*net.IPNet)
+	return subnet
+}
+
+// withClientSubnet carry the subnet of client in the context, the query from
+// a client that has sent its own subnet is kept as it is
+func (r *Resolver) withClientSubnet(ctx context.Context, m *dns.Msg) context.Context {
+	if !r.ecs || ecsOption(m) != nil {
+		return ctx
+	}
+	dCtx := dnsContextFrom(ctx)
+	if dCtx == nil || dCtx.RemoteAddr() == nil {
+		return ctx
+	}
+
+	host, _, err := net.SplitHostPort(dCtx.RemoteAddr().String())
+	if err != nil {
+		return ctx
+	}
+	ip := net.ParseIP(host)
+	// the private address means nothing to upstream
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return ctx
+	}
+
+	prefix := r.ecsIPv4Prefix
+	if ip.To4() == nil {
+		prefix = r.ecsIPv6Prefix
+	}
+	return contextWithClientSubnet(ctx, truncateSubnet(ip, prefix))
+}
+
+func ecsOption(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// setECS replace the client subnet option of msg
+func setECS(m *dns.Msg, subnet *net.IPNet) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(4096, false)
+		opt = m.IsEdns0()
+	}
+	removeECS(m)
+
+	ones, _ := subnet.Mask.Size()
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: uint8(ones),
+		Address:       subnet.IP,
+	}
+	if subnet.IP.To4() == nil {
+		ecs.Family = 2
+	}
+	opt.Option = append(opt.Option, ecs)
+}
+
+// removeECS remove the client subnet option of msg
+func removeECS(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_SUBNET); !ok {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+func truncateSubnet(ip net.IP, prefix int) *net.IPNet {
+	bits := 128
+	if v4 := ip.To4(); v4 != nil {
+		ip, bits = v4, 32
+	}
+	if prefix > bits {
+		prefix = bits
+	}
+	mask := net.CIDRMask(prefix, bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
@@ -0,0 +1,69 @@
+package dns
+
+import (
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/xmapst/mixed-socks/internal/context"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	hijackHandler handler
+	hijackACL     *accessControl
+	hijackMux     sync.RWMutex
+
+	errHijackDropped = errors.New("dropped by acl")
+)
+
+func setHijackHandler(h handler, acl *accessControl) {
+	hijackMux.Lock()
+	defer hijackMux.Unlock()
+	hijackHandler = h
+	hijackACL = acl
+}
+
+// HandleHijack answer the query in wire format with the handler chain of the DNS server,
+// for the queries hijacked from the proxied traffic. the ACL of the server applies to remote
+func HandleHijack(local, remote net.Addr, query []byte) ([]byte, error) {
+	hijackMux.RLock()
+	h, acl := hijackHandler, hijackACL
+	hijackMux.RUnlock()
+	if h == nil {
+		return nil, errors.New("DNS server disabled")
+	}
+
+	r := &dns.Msg{}
+	if err := r.Unpack(query); err != nil {
+		return nil, err
+	}
+	if len(r.Question) == 0 {
+		return nil, errors.New("should have one question at least")
+	}
+
+	start := time.Now()
+	ctx := context.NewDNSContext(local, remote, r)
+	if acl != nil {
+		switch acl.check(remote, r) {
+		case aclRefuse:
+			ctx.SetType(context.DNSTypeRefused)
+			msg := refusedMsg(r)
+			DefaultQueryLog.Push(newQuery(ctx, r, msg, nil, start))
+			return msg.Pack()
+		case aclTruncate:
+			return truncatedMsg(r).Pack()
+		case aclDrop:
+			return nil, errHijackDropped
+		}
+	}
+
+	msg, err := h(ctx, r)
+	DefaultQueryLog.Push(newQuery(ctx, r, msg, err, start))
+	if err != nil {
+		msg = &dns.Msg{}
+		msg.SetRcode(r, dns.RcodeServerFailure)
+	}
+	msg.Compress = true
+	return msg.Pack()
+}
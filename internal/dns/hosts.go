@@ -0,0 +1,78 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"github.com/xmapst/mixed-socks/internal/component/resolver"
+	"github.com/xmapst/mixed-socks/internal/component/trie"
+	"strings"
+)
+
+const maxHostsCNAMEChain = resolver.MaxHostsCNAMEChain
+
+func searchHosts(hosts *trie.DomainTrie, name string) *resolver.HostRecord {
+	node := hosts.Search(strings.ToLower(strings.TrimRight(name, ".")))
+	if node == nil {
+		return nil
+	}
+	return node.Data.(*resolver.HostRecord)
+}
+
+// hostRecordRRs return the records of qtype, all records for ANY
+func hostRecordRRs(name string, record *resolver.HostRecord, qtype uint16) []dns.RR {
+	hdr := func(rtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rtype, Class: dns.ClassINET, Ttl: dnsDefaultTTL}
+	}
+
+	var rrs []dns.RR
+	switch qtype {
+	case dns.TypeA:
+		for _, ip := range record.IPv4() {
+			rrs = append(rrs, &dns.A{Hdr: hdr(dns.TypeA), A: ip})
+		}
+	case dns.TypeAAAA:
+		for _, ip := range record.IPv6() {
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: ip})
+		}
+	case dns.TypeCNAME:
+		if record.CNAME != "" {
+			rrs = append(rrs, &dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: dns.Fqdn(record.CNAME)})
+		}
+	case dns.TypeTXT:
+		for _, txt := range record.TXT {
+			rrs = append(rrs, &dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: splitTXT(txt)})
+		}
+	case dns.TypeMX:
+		for _, mx := range record.MX {
+			rrs = append(rrs, &dns.MX{Hdr: hdr(dns.TypeMX), Preference: mx.Preference, Mx: dns.Fqdn(mx.Host)})
+		}
+	case dns.TypeSRV:
+		for _, srv := range record.SRV {
+			rrs = append(rrs, &dns.SRV{
+				Hdr:      hdr(dns.TypeSRV),
+				Priority: srv.Priority,
+				Weight:   srv.Weight,
+				Port:     srv.Port,
+				Target:   dns.Fqdn(srv.Target),
+			})
+		}
+	case dns.TypePTR:
+		for _, ptr := range record.PTR {
+			rrs = append(rrs, &dns.PTR{Hdr: hdr(dns.TypePTR), Ptr: dns.Fqdn(ptr)})
+		}
+	case dns.TypeANY:
+		for _, t := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeTXT, dns.TypeMX, dns.TypeSRV, dns.TypePTR} {
+			rrs = append(rrs, hostRecordRRs(name, record, t)...)
+		}
+	}
+	return rrs
+}
+
+// splitTXT split the text into character-strings, at most 255 bytes each
+func splitTXT(txt string) []string {
+	var ret []string
+	for len(txt) > 255 {
+		ret = append(ret, txt[:255])
+		txt = txt[255:]
+	}
+	return append(ret, txt)
+}
@@ -0,0 +1,125 @@
+package dns
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/mixed-socks/internal/component/trie"
+	"strconv"
+	"strings"
+)
+
+// privateReverseZones are the reverse zones of private ranges (RFC 6303),
+// their PTR must never be sent to public upstreams
+var privateReverseZones = func() []string {
+	zones := []string{
+		"10.in-addr.arpa",
+		"168.192.in-addr.arpa",
+		"254.169.in-addr.arpa",
+		"127.in-addr.arpa",
+		"0.in-addr.arpa",
+		// fc00::/7
+		"c.f.ip6.arpa",
+		"d.f.ip6.arpa",
+		// fe80::/10
+		"8.e.f.ip6.arpa",
+		"9.e.f.ip6.arpa",
+		"a.e.f.ip6.arpa",
+		"b.e.f.ip6.arpa",
+		// ::1
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa",
+	}
+	// 172.16.0.0/12
+	for i := 16; i < 32; i++ {
+		zones = append(zones, strconv.Itoa(i)+".172.in-addr.arpa")
+	}
+	// 100.64.0.0/10, the shared address space of CGNAT (RFC 6598)
+	for i := 64; i < 128; i++ {
+		zones = append(zones, strconv.Itoa(i)+".100.in-addr.arpa")
+	}
+	return zones
+}()
+
+// LocalConfig forward the queries of local zones to the LAN resolver
+type LocalConfig struct {
+	// NameServers are the LAN resolvers, dhcp supported
+	NameServers []NameServer
+	// SearchDomains are forwarded to the LAN resolver, and single-label names too
+	SearchDomains []string
+	// PrivateReverse forward the PTR of private ranges to the LAN resolver,
+	// and answer NXDOMAIN if unresolvable
+	PrivateReverse bool
+}
+
+type localForwarder struct {
+	clients []dnsClient
+	domains *trie.DomainTrie
+	private *trie.DomainTrie
+}
+
+// match return whether the query belongs to the local zones, and whether it is a private PTR
+func (f *localForwarder) match(q dns.Question) (local bool, private bool) {
+	name := strings.ToLower(strings.TrimRight(q.Name, "."))
+	if name == "" {
+		return false, false
+	}
+	if f.private != nil && f.private.Search(name) != nil {
+		return true, true
+	}
+	if len(f.clients) == 0 {
+		return false, false
+	}
+	if !strings.Contains(name, ".") || f.domains.Search(name) != nil {
+		return true, false
+	}
+	return false, false
+}
+
+// localExchange forward the query to the LAN resolver,
+// the private PTR is answered with NXDOMAIN if it is unresolvable
+func (r *Resolver) localExchange(ctx context.Context, m *dns.Msg, private bool) (*dns.Msg, error) {
+	if len(r.local.clients) != 0 {
+		msg, err := r.batchExchange(ctx, r.local.clients, m)
+		if err == nil {
+			return msg, nil
+		}
+		if !private {
+			return nil, err
+		}
+		logrus.Debugf("[DNS] local exchange %s failed: %s", m.Question[0].String(), err)
+	}
+
+	msg := &dns.Msg{}
+	msg.SetRcode(m, dns.RcodeNameError)
+	msg.RecursionAvailable = true
+	return msg, nil
+}
+
+func (r *Resolver) localClients() []dnsClient {
+	if r.local == nil {
+		return nil
+	}
+	return r.local.clients
+}
+
+func newLocalForwarder(cfg *LocalConfig, r *Resolver) *localForwarder {
+	if cfg == nil {
+		return nil
+	}
+	f := &localForwarder{
+		clients: newUpstreams(transform(cfg.NameServers, r)),
+		domains: trie.New(),
+	}
+	for _, domain := range cfg.SearchDomains {
+		if err := f.domains.Insert("+."+strings.ToLower(strings.Trim(domain, ".")), true); err != nil {
+			logrus.Warnf("[DNS] search domain %s: %s", domain, err)
+		}
+	}
+	if cfg.PrivateReverse {
+		f.private = trie.New()
+		for _, zone := range privateReverseZones {
+			_ = f.private.Insert("+."+zone, true)
+		}
+	}
+	return f
+}
@@ -1,6 +1,8 @@
 package dns
 
 import (
+	stdcontext "context"
+	"fmt"
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 	"github.com/xmapst/mixed-socks/internal/common/cache"
@@ -22,34 +24,43 @@ func withHosts(hosts *trie.DomainTrie) middleware {
 			ctx.SetType(context.DNSTypeHost)
 			q := r.Question[0]
 
-			if !isIPRequest(q) {
-				return next(ctx, r)
-			}
-
-			record := hosts.Search(strings.TrimRight(q.Name, "."))
-			if record == nil {
+			record := searchHosts(hosts, q.Name)
+			if record == nil || q.Qclass != dns.ClassINET {
 				return next(ctx, r)
 			}
 
-			ip := record.Data.(net.IP)
 			msg := r.Copy()
+			name := q.Name
 
-			if v4 := ip.To4(); v4 != nil && q.Qtype == dns.TypeA {
-				rr := &dns.A{}
-				rr.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: dnsDefaultTTL}
-				rr.A = v4
-
-				msg.Answer = []dns.RR{rr}
-			} else if v6 := ip.To16(); v6 != nil && q.Qtype == dns.TypeAAAA {
-				rr := &dns.AAAA{}
-				rr.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: dnsDefaultTTL}
-				rr.AAAA = v6
-
-				msg.Answer = []dns.RR{rr}
-			} else {
-				return next(ctx, r)
+			// follow the CNAME chain in hosts
+			for i := 0; record.CNAME != "" && q.Qtype != dns.TypeCNAME; i++ {
+				if i >= maxHostsCNAMEChain {
+					return nil, fmt.Errorf("too long CNAME chain in hosts: %s", q.Name)
+				}
+				target := dns.Fqdn(record.CNAME)
+				msg.Answer = append(msg.Answer, hostRecordRRs(name, record, dns.TypeCNAME)...)
+				name = target
+
+				record = searchHosts(hosts, target)
+				if record == nil {
+					// the target is not in hosts, resolve it by upstream
+					req := r.Copy()
+					req.Question[0].Name = target
+					resp, err := next(ctx, req)
+					if err != nil {
+						return nil, err
+					}
+					msg.Answer = append(msg.Answer, resp.Answer...)
+					msg.Ns = resp.Ns
+					msg.SetRcode(r, resp.Rcode)
+					msg.RecursionAvailable = true
+					return msg, nil
+				}
 			}
-			logrus.Infof("[DNS] %s --> %s --> %s", ctx.RemoteAddr().String(), strings.TrimSuffix(q.Name, "."), ip)
+
+			// the name is in hosts, answer NODATA if no record of the type
+			msg.Answer = append(msg.Answer, hostRecordRRs(name, record, q.Qtype)...)
+			logrus.Infof("[DNS] %s --> %s %s --> %d records from hosts", ctx.RemoteAddr().String(), strings.TrimSuffix(q.Name, "."), dns.TypeToString[q.Qtype], len(msg.Answer))
 			msg.SetRcode(r, dns.RcodeSuccess)
 			msg.Authoritative = true
 			msg.RecursionAvailable = true
@@ -59,6 +70,24 @@ func withHosts(hosts *trie.DomainTrie) middleware {
 	}
 }
 
+func withBlocklist(blocker *Blocker) middleware {
+	return func(next handler) handler {
+		return func(ctx *context.DNSContext, r *dns.Msg) (*dns.Msg, error) {
+			q := r.Question[0]
+
+			list := blocker.Match(strings.ToLower(strings.TrimRight(q.Name, ".")))
+			if list == nil {
+				return next(ctx, r)
+			}
+
+			ctx.SetType(context.DNSTypeBlock)
+			list.Hit()
+			logrus.Infof("[DNS] %s --> %s blocked by %s", ctx.RemoteAddr().String(), strings.TrimSuffix(q.Name, "."), list.Name())
+			return blockedMsg(blocker.Mode(), r), nil
+		}
+	}
+}
+
 func withMapping(mapping *cache.LruCache) middleware {
 	return func(next handler) handler {
 		return func(ctx *context.DNSContext, r *dns.Msg) (*dns.Msg, error) {
@@ -105,18 +134,25 @@ func withResolver(resolver *Resolver) handler {
 		ctx.SetType(context.DNSTypeRaw)
 		q := r.Question[0]
 
-		// return a empty AAAA msg when ipv6 disabled
-		if q.Qtype == dns.TypeAAAA {
+		// return a empty A/AAAA msg when the ip version disabled
+		if isIPVersionDisabled(q) {
 			return handleMsgWithEmptyAnswer(r), nil
 		}
 
-		msg, err := resolver.Exchange(r)
+		msg, err := resolver.ExchangeContext(withDNSContext(stdcontext.Background(), ctx), r)
 		if err != nil {
-			logrus.Debugln("[DNS] exchange --> %s failed: %v", q.String(), err)
+			logrus.Debugf("[DNS] exchange --> %s failed: %v", q.String(), err)
 			return msg, err
 		}
 		msg.SetRcode(r, msg.Rcode)
 		msg.Authoritative = true
+		if resolver.dnssec != nil {
+			stripDNSSEC(msg, r)
+		}
+		// the client subnet is sent by the resolver, not the client
+		if ecsOption(r) == nil {
+			removeECS(msg)
+		}
 
 		return msg, nil
 	}
@@ -140,7 +176,15 @@ func newHandler(resolver *Resolver, mapper *ResolverEnhancer) handler {
 		middlewares = append(middlewares, withHosts(resolver.hosts))
 	}
 
+	if resolver.blocker != nil {
+		middlewares = append(middlewares, withBlocklist(resolver.blocker))
+	}
+
 	middlewares = append(middlewares, withMapping(mapper.mapping))
 
+	if resolver.dns64 != nil {
+		middlewares = append(middlewares, withDNS64(resolver.dns64))
+	}
+
 	return compose(middlewares, withResolver(resolver))
 }
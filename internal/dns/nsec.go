@@ -0,0 +1,246 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// nsecRecord is a verified NSEC or NSEC3, with the zone signed it
+type nsecRecord struct {
+	rr   dns.RR
+	zone string
+}
+
+// denial proves the names or types not exist with the verified NSEC and NSEC3
+// records (RFC 4035 section 5.4, RFC 5155 section 8)
+type denial struct {
+	nsec  []nsecRecord
+	nsec3 []nsecRecord
+}
+
+func (d *denial) add(set []dns.RR, zone string) {
+	zone = dns.CanonicalName(zone)
+	for _, rr := range set {
+		switch n := rr.(type) {
+		case *dns.NSEC:
+			d.nsec = append(d.nsec, nsecRecord{rr: n, zone: zone})
+		case *dns.NSEC3:
+			// only SHA-1 is defined, the others can't prove anything
+			if n.Hash == dns.SHA1 {
+				d.nsec3 = append(d.nsec3, nsecRecord{rr: n, zone: zone})
+			}
+		}
+	}
+}
+
+// nxDomain prove the name not exist, and no wildcard could be expanded to it
+func (d *denial) nxDomain(name string) bool {
+	name = dns.CanonicalName(name)
+	if ce, ok := d.nsecClosestEncloser(name); ok && d.nsecCovered("*."+ce) {
+		return true
+	}
+	if ce, _, ok := d.nsec3ClosestEncloser(name); ok && d.nsec3Covering("*."+ce) != nil {
+		return true
+	}
+	return false
+}
+
+// noData prove the name exists without the type, or the wildcard matches it does
+func (d *denial) noData(name string, qtype uint16) bool {
+	name = dns.CanonicalName(name)
+	if d.nsecMatched(name, qtype) {
+		return true
+	}
+	if m := d.nsec3Matching(name); m != nil && noType(m.(*dns.NSEC3).TypeBitMap, name, qtype) {
+		return true
+	}
+
+	for _, r := range d.nsec {
+		n := r.rr.(*dns.NSEC)
+		// empty non-terminal, the next name is below it
+		next := dns.CanonicalName(n.NextDomain)
+		if nsecCovers(r, name) && next != name && dns.IsSubDomain(name, next) {
+			return true
+		}
+	}
+	if ce, ok := d.nsecClosestEncloser(name); ok && d.nsecMatched("*."+ce, qtype) {
+		return true
+	}
+
+	if ce, nextCloser, ok := d.nsec3ClosestEncloser(name); ok {
+		if m := d.nsec3Matching("*." + ce); m != nil && noType(m.(*dns.NSEC3).TypeBitMap, "*."+ce, qtype) {
+			return true
+		}
+		// the insecure delegation in an opt-out span (RFC 5155 section 8.6)
+		if c := d.nsec3Covering(nextCloser); qtype == dns.TypeDS && c != nil && c.(*dns.NSEC3).Flags&1 == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardExpanded prove the name of the answer not exist, so the wildcard
+// of the RRSIG labels could be expanded (RFC 4035 section 5.3.4, RFC 5155 section 8.8)
+func (d *denial) wildcardExpanded(name string, labels int) bool {
+	name = dns.CanonicalName(name)
+	for _, r := range d.nsec {
+		if nsecCovers(r, name) {
+			return true
+		}
+	}
+	return d.nsec3Covering(lastLabels(name, labels+1)) != nil
+}
+
+// nsecClosestEncloser return the closest encloser of the name proven not exist
+func (d *denial) nsecClosestEncloser(name string) (string, bool) {
+	for _, r := range d.nsec {
+		if !nsecCovers(r, name) {
+			continue
+		}
+		n := r.rr.(*dns.NSEC)
+		// the longest ancestor of name which is the owner or next name, or their ancestor
+		ce := commonAncestor(name, n.Hdr.Name)
+		if next := commonAncestor(name, n.NextDomain); dns.CountLabel(next) > dns.CountLabel(ce) {
+			ce = next
+		}
+		return ce, true
+	}
+	return "", false
+}
+
+func (d *denial) nsecCovered(name string) bool {
+	for _, r := range d.nsec {
+		if nsecCovers(r, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *denial) nsecMatched(name string, qtype uint16) bool {
+	for _, r := range d.nsec {
+		n := r.rr.(*dns.NSEC)
+		if dns.CanonicalName(n.Hdr.Name) == name && noType(n.TypeBitMap, name, qtype) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *denial) nsec3Matching(name string) dns.RR {
+	for _, r := range d.nsec3 {
+		if dns.IsSubDomain(r.zone, name) && r.rr.(*dns.NSEC3).Match(name) {
+			return r.rr
+		}
+	}
+	return nil
+}
+
+func (d *denial) nsec3Covering(name string) dns.RR {
+	for _, r := range d.nsec3 {
+		n := r.rr.(*dns.NSEC3)
+		if dns.IsSubDomain(r.zone, name) && n.Cover(name) && !n.Match(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+// nsec3ClosestEncloser find the closest encloser proof of the name (RFC 5155 section 8.3),
+// return the closest encloser and the next closer name
+func (d *denial) nsec3ClosestEncloser(name string) (string, string, bool) {
+	nextCloser := name
+	for nextCloser != "." {
+		ce := parentName(nextCloser)
+		if m := d.nsec3Matching(ce); m != nil {
+			bitmap := m.(*dns.NSEC3).TypeBitMap
+			// the names below a delegation or DNAME are not in the zone
+			if hasType(bitmap, dns.TypeDNAME) || hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA) {
+				return "", "", false
+			}
+			return ce, nextCloser, d.nsec3Covering(nextCloser) != nil
+		}
+		nextCloser = ce
+	}
+	return "", "", false
+}
+
+// nsecCovers return whether the name is between the owner and next name of the NSEC
+func nsecCovers(r nsecRecord, name string) bool {
+	n := r.rr.(*dns.NSEC)
+	owner, next := dns.CanonicalName(n.Hdr.Name), dns.CanonicalName(n.NextDomain)
+	if owner == name || !dns.IsSubDomain(r.zone, name) {
+		return false
+	}
+	// the names below a delegation or DNAME are not in the zone (RFC 6840 section 4.1)
+	if dns.IsSubDomain(owner, name) && (hasType(n.TypeBitMap, dns.TypeDNAME) ||
+		hasType(n.TypeBitMap, dns.TypeNS) && !hasType(n.TypeBitMap, dns.TypeSOA)) {
+		return false
+	}
+	if canonicalCompare(next, owner) <= 0 {
+		// the last NSEC of zone
+		return canonicalCompare(owner, name) < 0
+	}
+	return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+}
+
+// noType return whether the bitmap proves the type not exist at name
+func noType(bitmap []uint16, name string, qtype uint16) bool {
+	if hasType(bitmap, qtype) || qtype != dns.TypeCNAME && hasType(bitmap, dns.TypeCNAME) {
+		return false
+	}
+	delegation := hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA)
+	if qtype == dns.TypeDS {
+		// the DS is proven by the parent, never the apex of child
+		return name == "." || !hasType(bitmap, dns.TypeSOA)
+	}
+	// the record of parent side can't prove the types of child zone
+	return !delegation
+}
+
+func hasType(bitmap []uint16, rtype uint16) bool {
+	for _, t := range bitmap {
+		if t == rtype {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalCompare compare the domain names in canonical order (RFC 4034 section 6.1)
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(dns.CanonicalName(a))
+	lb := dns.SplitDomainName(dns.CanonicalName(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// commonAncestor return the longest common ancestor of the names
+func commonAncestor(a, b string) string {
+	return lastLabels(a, dns.CompareDomainName(a, b))
+}
+
+// lastLabels return the ancestor of name with n labels
+func lastLabels(name string, n int) string {
+	labels := dns.SplitDomainName(dns.CanonicalName(name))
+	if n <= 0 {
+		return "."
+	}
+	if n > len(labels) {
+		n = len(labels)
+	}
+	return strings.Join(labels[len(labels)-n:], ".") + "."
+}
+
+// signedLabels return the label count of name in RRSIG, without the wildcard label
+func signedLabels(name string) int {
+	count := dns.CountLabel(name)
+	if strings.HasPrefix(name, "*.") {
+		count--
+	}
+	return count
+}
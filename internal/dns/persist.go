@@ -0,0 +1,139 @@
+package dns
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// PersistInterval is the interval of saving the cache snapshot
+const PersistInterval = 5 * time.Minute
+
+// answerConfig is the settings of resolver change the answers
+type answerConfig struct {
+	DNSSEC *DNSSECConfig
+	DNS64  *net.IPNet
+	Local  *LocalConfig
+	ECS    []*ECSConfig
+}
+
+type cacheSnapshot struct {
+	Version int                  `json:"version"`
+	Entries []cacheSnapshotEntry `json:"entries"`
+}
+
+type cacheSnapshotEntry struct {
+	Key     string `json:"key"`
+	Msg     []byte `json:"msg"`
+	TTL     uint32 `json:"ttl"`
+	Expires int64  `json:"expires"`
+}
+
+// SaveCache snapshot the cache with the expires to file
+func (r *Resolver) SaveCache() error {
+	if r.persistFile == "" {
+		return nil
+	}
+
+	snapshot := cacheSnapshot{Version: 1}
+	r.lruCache.Range(func(key any, value any, expires time.Time) bool {
+		// the entry can't be served anymore
+		if time.Since(expires) > r.cacheCfg.StaleWindow {
+			return true
+		}
+		item := value.(*cacheItem)
+		buf, err := item.msg.Pack()
+		if err != nil {
+			return true
+		}
+		snapshot.Entries = append(snapshot.Entries, cacheSnapshotEntry{
+			Key:     key.(string),
+			Msg:     buf,
+			TTL:     item.ttl,
+			Expires: expires.Unix(),
+		})
+		return true
+	})
+
+	buf, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(r.persistFile), 0o755); err != nil {
+		return err
+	}
+	// write to a temp file first, never leave a broken snapshot
+	tmp := r.persistFile + ".tmp"
+	if err = os.WriteFile(tmp, buf, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.persistFile)
+}
+
+// LoadCache restore the cache from the snapshot file
+func (r *Resolver) LoadCache() error {
+	if r.persistFile == "" {
+		return nil
+	}
+
+	buf, err := os.ReadFile(r.persistFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	snapshot := cacheSnapshot{}
+	if err = json.Unmarshal(buf, &snapshot); err != nil {
+		return err
+	}
+
+	// entries are saved from the least recently used, keep the order
+	for _, e := range snapshot.Entries {
+		msg := &dns.Msg{}
+		if err := msg.Unpack(e.Msg); err != nil {
+			continue
+		}
+		r.lruCache.SetWithExpire(e.Key, newCacheItem(msg, e.TTL), time.Unix(e.Expires, 0))
+	}
+	logrus.Infof("[DNS] restored %d cache entries from %s", len(snapshot.Entries), r.persistFile)
+	return nil
+}
+
+// PatchFrom reuse the cache of old resolver if the answers are not affected by
+// the new settings, and its blocker if the lists unchanged
+func (r *Resolver) PatchFrom(o *Resolver) {
+	// the answers cached with other settings are not valid anymore
+	if r.lruCache != nil && o.lruCache != nil && reflect.DeepEqual(r.answerCfg, o.answerCfg) {
+		o.lruCache.CloneTo(r.lruCache)
+	}
+	if r.blocker != nil && o.blocker != nil {
+		if r.blocker.sameConfig(o.blocker) {
+			r.blocker = o.blocker.retain()
+		} else {
+			r.blocker.inherit(o.blocker)
+		}
+	}
+}
+
+func (r *Resolver) persist() {
+	ticker := time.NewTicker(PersistInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.SaveCache(); err != nil {
+				logrus.Warnf("[DNS] save cache failed: %s", err)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
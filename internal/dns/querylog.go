@@ -0,0 +1,272 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"github.com/xmapst/mixed-socks/internal/component/metrics"
+	icontext "github.com/xmapst/mixed-socks/internal/context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultQueryLog record the recent queries of the DNS server
+var DefaultQueryLog = NewQueryLog(1000)
+
+// Query is a finished query of the DNS server
+type Query struct {
+	ID       string        `json:"id"`
+	Time     time.Time     `json:"time"`
+	Client   string        `json:"client"`
+	Name     string        `json:"name"`
+	QType    string        `json:"qtype"`
+	Rcode    string        `json:"rcode"`
+	Answers  []string      `json:"answers"`
+	Upstream string        `json:"upstream"`
+	Type     string        `json:"type"`
+	CacheHit bool          `json:"cacheHit"`
+	Latency  time.Duration `json:"latency"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// QueryFilter is used to filter the recent queries, empty field match all
+type QueryFilter struct {
+	Client   string
+	Name     string
+	QType    string
+	Rcode    string
+	Upstream string
+	Type     string
+	Limit    int
+}
+
+// Match return whether the query matches the filter
+func (f *QueryFilter) Match(q *Query) bool {
+	if f.Client != "" && !strings.HasPrefix(q.Client, f.Client) {
+		return false
+	}
+	if f.Name != "" && !strings.Contains(q.Name, strings.ToLower(f.Name)) {
+		return false
+	}
+	if f.QType != "" && !strings.EqualFold(q.QType, f.QType) {
+		return false
+	}
+	if f.Rcode != "" && !strings.EqualFold(q.Rcode, f.Rcode) {
+		return false
+	}
+	if f.Upstream != "" && !strings.Contains(q.Upstream, f.Upstream) {
+		return false
+	}
+	if f.Type != "" && q.Type != f.Type {
+		return false
+	}
+	return true
+}
+
+// QueryStats is the aggregated counters of the DNS server
+type QueryStats struct {
+	Total      int64            `json:"total"`
+	CacheHits  int64            `json:"cacheHits"`
+	Errors     int64            `json:"errors"`
+	AvgLatency time.Duration    `json:"avgLatency"`
+	Rcode      map[string]int64 `json:"rcode"`
+	QType      map[string]int64 `json:"qtype"`
+	Type       map[string]int64 `json:"type"`
+	Upstream   map[string]int64 `json:"upstream"`
+}
+
+type QueryLog struct {
+	mux     sync.RWMutex
+	queries []*Query
+	next    int
+	full    bool
+
+	stats        QueryStats
+	totalLatency time.Duration
+
+	subscribers map[chan *Query]struct{}
+}
+
+// SetSize resize the ring buffer, keep the latest queries
+func (l *QueryLog) SetSize(size int) {
+	if size <= 0 {
+		size = 1
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if size == len(l.queries) {
+		return
+	}
+
+	recent := l.recent()
+	if len(recent) > size {
+		recent = recent[len(recent)-size:]
+	}
+	l.queries = make([]*Query, size)
+	copy(l.queries, recent)
+	l.next = len(recent) % size
+	l.full = len(recent) == size
+}
+
+// Push add a query to the ring buffer, update the counters and notify subscribers
+func (l *QueryLog) Push(q *Query) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.queries[l.next] = q
+	l.next = (l.next + 1) % len(l.queries)
+	if l.next == 0 {
+		l.full = true
+	}
+
+	l.stats.Total++
+	if q.CacheHit {
+		l.stats.CacheHits++
+	}
+	if q.Error != "" {
+		l.stats.Errors++
+	}
+	l.totalLatency += q.Latency
+	l.stats.AvgLatency = l.totalLatency / time.Duration(l.stats.Total)
+	l.stats.Rcode[q.Rcode]++
+	l.stats.QType[q.QType]++
+	l.stats.Type[q.Type]++
+	if q.Upstream != "" {
+		l.stats.Upstream[q.Upstream]++
+	}
+	observeQuery(q)
+
+	for ch := range l.subscribers {
+		// drop for slow subscriber, never block the DNS server
+		select {
+		case ch <- q:
+		default:
+		}
+	}
+}
+
+// Queries return the recent queries match the filter, newest first
+func (l *QueryLog) Queries(filter *QueryFilter) []*Query {
+	l.mux.RLock()
+	recent := l.recent()
+	l.mux.RUnlock()
+
+	queries := make([]*Query, 0, len(recent))
+	for i := len(recent) - 1; i >= 0; i-- {
+		if filter != nil && !filter.Match(recent[i]) {
+			continue
+		}
+		queries = append(queries, recent[i])
+		if filter != nil && filter.Limit > 0 && len(queries) >= filter.Limit {
+			break
+		}
+	}
+	return queries
+}
+
+// Stats return a copy of the aggregated counters
+func (l *QueryLog) Stats() *QueryStats {
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+
+	stats := l.stats
+	stats.Rcode = copyCounter(l.stats.Rcode)
+	stats.QType = copyCounter(l.stats.QType)
+	stats.Type = copyCounter(l.stats.Type)
+	stats.Upstream = copyCounter(l.stats.Upstream)
+	return &stats
+}
+
+// Subscribe return a channel receive new queries, call Unsubscribe when done
+func (l *QueryLog) Subscribe() chan *Query {
+	ch := make(chan *Query, 64)
+	l.mux.Lock()
+	l.subscribers[ch] = struct{}{}
+	l.mux.Unlock()
+	return ch
+}
+
+// Unsubscribe stop the channel receive new queries
+func (l *QueryLog) Unsubscribe(ch chan *Query) {
+	l.mux.Lock()
+	delete(l.subscribers, ch)
+	l.mux.Unlock()
+}
+
+// recent return queries in time order, must be called with lock held
+func (l *QueryLog) recent() []*Query {
+	if !l.full {
+		return append([]*Query{}, l.queries[:l.next]...)
+	}
+	return append(append([]*Query{}, l.queries[l.next:]...), l.queries[:l.next]...)
+}
+
+func copyCounter(counter map[string]int64) map[string]int64 {
+	c := make(map[string]int64, len(counter))
+	for k, v := range counter {
+		c[k] = v
+	}
+	return c
+}
+
+func NewQueryLog(size int) *QueryLog {
+	if size <= 0 {
+		size = 1
+	}
+	return &QueryLog{
+		queries: make([]*Query, size),
+		stats: QueryStats{
+			Rcode:    map[string]int64{},
+			QType:    map[string]int64{},
+			Type:     map[string]int64{},
+			Upstream: map[string]int64{},
+		},
+		subscribers: map[chan *Query]struct{}{},
+	}
+}
+
+func newQuery(ctx *icontext.DNSContext, r *dns.Msg, msg *dns.Msg, err error, start time.Time) *Query {
+	q := r.Question[0]
+	query := &Query{
+		ID:       ctx.ID().String(),
+		Time:     start,
+		Name:     strings.ToLower(strings.TrimRight(q.Name, ".")),
+		QType:    dns.TypeToString[q.Qtype],
+		Upstream: ctx.Upstream(),
+		Type:     ctx.Type(),
+		CacheHit: ctx.CacheHit(),
+		Latency:  time.Since(start),
+	}
+	if addr := ctx.RemoteAddr(); addr != nil {
+		query.Client = addr.String()
+	}
+	if err != nil {
+		query.Rcode = dns.RcodeToString[dns.RcodeServerFailure]
+		query.Error = err.Error()
+		return query
+	}
+
+	query.Rcode = dns.RcodeToString[msg.Rcode]
+	for _, rr := range msg.Answer {
+		query.Answers = append(query.Answers, strings.TrimPrefix(rr.String(), rr.Header().String()))
+	}
+	return query
+}
+
+func observeQuery(q *Query) {
+	result := strings.ToLower(q.Rcode)
+	if q.Error != "" {
+		result = "error"
+	}
+	metrics.DNSQueries.With(result, q.Upstream).Inc()
+	// the queries answered by hosts, blocklist or refused never reach the cache
+	if q.Type != icontext.DNSTypeRaw {
+		return
+	}
+	if q.CacheHit {
+		metrics.DNSCache.With("hit").Inc()
+	} else {
+		metrics.DNSCache.With("miss").Inc()
+	}
+}
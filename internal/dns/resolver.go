@@ -5,20 +5,21 @@ import (
 	"errors"
 	"fmt"
 	"github.com/miekg/dns"
-	"github.com/sirupsen/logrus"
 	"github.com/xmapst/mixed-socks/internal/common/cache"
 	"github.com/xmapst/mixed-socks/internal/component/resolver"
 	"github.com/xmapst/mixed-socks/internal/component/trie"
+	"go.uber.org/atomic"
 	"golang.org/x/sync/singleflight"
 	"math/rand"
 	"net"
 	"strings"
-	"time"
+	"sync"
 )
 
 type dnsClient interface {
 	Exchange(m *dns.Msg) (msg *dns.Msg, err error)
 	ExchangeContext(ctx context.Context, m *dns.Msg) (msg *dns.Msg, err error)
+	Address() string
 }
 
 type result struct {
@@ -28,41 +29,38 @@ type result struct {
 
 type Resolver struct {
 	hosts    *trie.DomainTrie
+	blocker  *Blocker
 	main     []dnsClient
 	group    singleflight.Group
 	lruCache *cache.LruCache
+	cacheCfg CacheConfig
+	dnssec   *dnssecValidator
+	local    *localForwarder
+	dns64    *net.IPNet
+
+	strategy string
+	fastestN int
+	rrIndex  *atomic.Uint64
+
+	// ecs is whether any nameserver send the subnet of client
+	ecs           bool
+	ecsIPv4Prefix int
+	ecsIPv6Prefix int
+
+	// answerCfg is the settings change the answers, the cache is dropped on reload if differ
+	answerCfg answerConfig
+
+	persistFile string
+	done        chan struct{}
+	closeOnce   sync.Once
 }
 
-// LookupIP request with TypeA and TypeAAAA, priority return TypeA
+// LookupIP request with TypeA and TypeAAAA, follow the ip preference
 func (r *Resolver) LookupIP(ctx context.Context, host string) (ip []net.IP, err error) {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	ch := make(chan []net.IP, 1)
-
-	go func() {
-		defer close(ch)
-		ip, err := r.lookupIP(ctx, host, dns.TypeAAAA)
-		if err != nil {
-			return
-		}
-		ch <- ip
-	}()
-
-	ip, err = r.lookupIP(ctx, host, dns.TypeA)
-	if err == nil {
-		return
-	}
-
-	ip, open := <-ch
-	if !open {
-		return nil, resolver.ErrIPNotFound
-	}
-
-	return ip, nil
+	return resolver.LookupIPByPreference(ctx, host, r.LookupIPv4, r.LookupIPv6)
 }
 
-// ResolveIP request with TypeA and TypeAAAA, priority return TypeA
+// ResolveIP request with TypeA and TypeAAAA, follow the ip preference
 func (r *Resolver) ResolveIP(host string) (ip net.IP, err error) {
 	ips, err := r.LookupIP(context.Background(), host)
 	if err != nil {
@@ -116,23 +114,12 @@ func (r *Resolver) ExchangeContext(ctx context.Context, m *dns.Msg) (msg *dns.Ms
 		return nil, errors.New("should have one question at least")
 	}
 
-	q := m.Question[0]
-	c, expireTime, hit := r.lruCache.GetWithExpire(q.String())
-	if hit {
-		now := time.Now()
-		msg = c.(*dns.Msg).Copy()
-		if expireTime.Before(now) {
-			setMsgTTL(msg, uint32(1)) // Continue fetch
-			go func() {
-				_, err = r.exchangeWithoutCache(ctx, m)
-				if err != nil {
-					logrus.Warnln(err.Error())
-				}
-			}()
-		} else {
-			setMsgTTL(msg, uint32(time.Until(expireTime).Seconds()))
+	ctx = r.withClientSubnet(ctx, m)
+	if msg, hit := r.getMsgFromCache(ctx, m); hit {
+		if dCtx := dnsContextFrom(ctx); dCtx != nil {
+			dCtx.SetCacheHit(true)
 		}
-		return
+		return msg, nil
 	}
 	return r.exchangeWithoutCache(ctx, m)
 }
@@ -140,8 +127,9 @@ func (r *Resolver) ExchangeContext(ctx context.Context, m *dns.Msg) (msg *dns.Ms
 // ExchangeWithoutCache a batch of dns request, and it do NOT GET from cache
 func (r *Resolver) exchangeWithoutCache(ctx context.Context, m *dns.Msg) (msg *dns.Msg, err error) {
 	q := m.Question[0]
+	key := cacheKey(ctx, m)
 
-	ret, err, shared := r.group.Do(q.String(), func() (result any, err error) {
+	ret, err, shared := r.group.Do(key, func() (result any, err error) {
 		defer func() {
 			if err != nil {
 				return
@@ -149,9 +137,19 @@ func (r *Resolver) exchangeWithoutCache(ctx context.Context, m *dns.Msg) (msg *d
 
 			msg := result.(*dns.Msg)
 
-			putMsgToCache(r.lruCache, q.String(), msg)
+			r.putMsgToCache(key, msg)
 		}()
 
+		if r.local != nil {
+			if local, private := r.local.match(q); local {
+				return r.localExchange(ctx, m, private)
+			}
+		}
+
+		if r.dnssec != nil {
+			return r.validatedExchange(ctx, m)
+		}
+
 		isIPReq := isIPRequest(q)
 		if isIPReq {
 			return r.ipExchange(ctx, m)
@@ -173,7 +171,28 @@ func (r *Resolver) batchExchange(ctx context.Context, clients []dnsClient, m *dn
 	ctx, cancel := context.WithTimeout(ctx, resolver.DefaultDNSTimeout)
 	defer cancel()
 
-	return batchExchange(ctx, clients, m)
+	return r.exchangeByStrategy(ctx, clients, m)
+}
+
+// validatedExchange request with DO bit and validate the answer,
+// the AD bit is set on the secure answer
+func (r *Resolver) validatedExchange(ctx context.Context, m *dns.Msg) (msg *dns.Msg, err error) {
+	msg, err = r.batchExchange(ctx, r.main, withDNSSECOK(m))
+	if err != nil {
+		return nil, err
+	}
+	// the client disables the checking, return the answer without validation (RFC 4035 section 3.2.2)
+	if m.CheckingDisabled {
+		msg.AuthenticatedData = false
+		return msg, nil
+	}
+
+	secure, err := r.dnssec.validate(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	msg.AuthenticatedData = secure
+	return msg, nil
 }
 
 func (r *Resolver) ipExchange(ctx context.Context, m *dns.Msg) (msg *dns.Msg, err error) {
@@ -230,21 +249,97 @@ func (r *Resolver) asyncExchange(ctx context.Context, client []dnsClient, msg *d
 }
 
 type NameServer struct {
-	Net       string
-	Addr      string
-	Interface string
+	Net          string
+	Addr         string
+	Interface    string
+	ProxyAdapter string
+	ECS          *ECSConfig
 }
 
 type Config struct {
 	NameServers []NameServer
-	Hosts       *trie.DomainTrie
+	// Strategy is how the upstreams are selected, parallel-all by default
+	Strategy string
+	// FastestN is the count of upstreams queried by fastest-n
+	FastestN int
+	Hosts    *trie.DomainTrie
+	Blocker  *BlockerConfig
+	Cache    CacheConfig
+	// DNSSEC enable the validation when not nil
+	DNSSEC *DNSSECConfig
+	// DNS64 is the NAT64 prefix to synthesize AAAA records, nil means disabled
+	DNS64 *net.IPNet
+	// Local forward the local zones to the LAN resolver when not nil
+	Local *LocalConfig
+	// PersistFile is the file to snapshot the cache, empty means disabled
+	PersistFile string
+}
+
+// StartBlocker load the block lists, call after PatchFrom, before serving
+func (r *Resolver) StartBlocker() {
+	if r.blocker != nil {
+		r.blocker.start()
+	}
+}
+
+// Blocker return the blocker of resolver, nil if block lists disabled
+func (r *Resolver) Blocker() *Blocker {
+	return r.blocker
+}
+
+// Close release the resources of resolver
+func (r *Resolver) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+	if r.blocker != nil {
+		r.blocker.Close()
+	}
 }
 
 func NewResolver(config Config) *Resolver {
 	r := &Resolver{
-		main:     transform(config.NameServers, nil),
-		lruCache: cache.New(cache.WithSize(65535), cache.WithStale(true)),
+		main:     newUpstreams(transform(config.NameServers, nil)),
+		strategy: config.Strategy,
+		fastestN: config.FastestN,
+		rrIndex:  atomic.NewUint64(0),
+		lruCache: newCache(),
+		cacheCfg: config.Cache,
 		hosts:    config.Hosts,
+		dns64:    config.DNS64,
+
+		answerCfg: answerConfig{
+			DNSSEC: config.DNSSEC,
+			DNS64:  config.DNS64,
+			Local:  config.Local,
+		},
+
+		persistFile: config.PersistFile,
+		done:        make(chan struct{}),
+	}
+	if config.Blocker != nil {
+		r.blocker = NewBlocker(*config.Blocker)
+	}
+	// the subnet of client is kept as fine as the finest nameserver needs
+	for _, s := range config.NameServers {
+		r.answerCfg.ECS = append(r.answerCfg.ECS, s.ECS)
+		if s.ECS == nil || s.ECS.Subnet != nil {
+			continue
+		}
+		r.ecs = true
+		if s.ECS.IPv4Prefix > r.ecsIPv4Prefix {
+			r.ecsIPv4Prefix = s.ECS.IPv4Prefix
+		}
+		if s.ECS.IPv6Prefix > r.ecsIPv6Prefix {
+			r.ecsIPv6Prefix = s.ECS.IPv6Prefix
+		}
+	}
+	r.local = newLocalForwarder(config.Local, r)
+	if config.DNSSEC != nil {
+		r.dnssec = newDNSSECValidator(r, config.DNSSEC)
+	}
+	if r.persistFile != "" {
+		go r.persist()
 	}
 	return r
 }
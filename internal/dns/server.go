@@ -1,12 +1,12 @@
 package dns
 
 import (
-	"errors"
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 	"github.com/xmapst/mixed-socks/internal/common/sockopt"
 	"github.com/xmapst/mixed-socks/internal/context"
 	"net"
+	"time"
 )
 
 var (
@@ -18,42 +18,76 @@ var (
 
 type Server struct {
 	*dns.Server
+	tcp     *dns.Server
 	handler handler
+	acl     *accessControl
 }
 
 // ServeDNS implement dns.Handler ServeDNS
 func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
-	msg, err := handlerWithContext(s.handler, w, r)
-	if err != nil {
+	if len(r.Question) == 0 {
 		dns.HandleFailed(w, r)
 		return
 	}
-	msg.Compress = true
-	_ = w.WriteMsg(msg)
-}
 
-func handlerWithContext(handler handler, w dns.ResponseWriter, msg *dns.Msg) (*dns.Msg, error) {
-	if len(msg.Question) == 0 {
-		return nil, errors.New("at least one question is required")
+	start := time.Now()
+	ctx := context.NewDNSContext(w.LocalAddr(), w.RemoteAddr(), r)
+	if s.acl != nil {
+		switch s.acl.check(w.RemoteAddr(), r) {
+		case aclRefuse:
+			ctx.SetType(context.DNSTypeRefused)
+			msg := refusedMsg(r)
+			DefaultQueryLog.Push(newQuery(ctx, r, msg, nil, start))
+			_ = w.WriteMsg(msg)
+			return
+		case aclTruncate:
+			_ = w.WriteMsg(truncatedMsg(r))
+			return
+		case aclDrop:
+			return
+		}
 	}
 
-	ctx := context.NewDNSContext(w.LocalAddr(), w.RemoteAddr(), msg)
-	return handler(ctx, msg)
+	msg, err := s.handler(ctx, r)
+	DefaultQueryLog.Push(newQuery(ctx, r, msg, err, start))
+	if err != nil {
+		dns.HandleFailed(w, r)
+		return
+	}
+	msg.Compress = true
+	_ = w.WriteMsg(msg)
 }
 
 func (s *Server) setHandler(handler handler) {
 	s.handler = handler
 }
 
-func ReCreateServer(addr string, resolver *Resolver, mapper *ResolverEnhancer) {
+func (s *Server) setACL(acl *accessControl) {
+	s.acl = acl
+}
+
+func ReCreateServer(addr string, resolver *Resolver, mapper *ResolverEnhancer, acl *ACLConfig) {
+	// the hijacked queries are answered even if the server doesn't listen,
+	// limited by the same ACL as the server
+	a := newAccessControl(acl)
+	if resolver != nil {
+		setHijackHandler(newHandler(resolver, mapper), a)
+	} else {
+		setHijackHandler(nil, nil)
+	}
+
 	if addr == address && resolver != nil {
 		handler := newHandler(resolver, mapper)
 		server.setHandler(handler)
+		server.setACL(a)
 		return
 	}
 
 	if server.Server != nil {
 		_ = server.Shutdown()
+		if server.tcp != nil {
+			_ = server.tcp.Shutdown()
+		}
 		server = &Server{}
 		address = ""
 	}
@@ -92,12 +126,22 @@ func ReCreateServer(addr string, resolver *Resolver, mapper *ResolverEnhancer) {
 
 	address = addr
 	h := newHandler(resolver, mapper)
-	server = &Server{handler: h}
+	server = &Server{handler: h, acl: a}
 	server.Server = &dns.Server{Addr: addr, PacketConn: p, Handler: server}
 
 	go func() {
 		_ = server.ActivateAndServe()
 	}()
 
+	// the truncated answers are retried over tcp
+	if l, tErr := net.Listen("tcp", addr); tErr == nil {
+		server.tcp = &dns.Server{Addr: addr, Listener: l, Handler: server}
+		go func() {
+			_ = server.tcp.ActivateAndServe()
+		}()
+	} else {
+		logrus.Warnf("DNS server listen tcp failed: %s", tErr)
+	}
+
 	logrus.Infof("DNS server listening at: %s", p.LocalAddr().String())
 }
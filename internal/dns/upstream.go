@@ -0,0 +1,257 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"go.uber.org/atomic"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StrategyParallelAll = "parallel-all"
+	StrategyFastestN    = "fastest-n"
+	StrategyRoundRobin  = "round-robin"
+	StrategySequential  = "sequential"
+
+	// upstreamAttemptTimeout is the timeout of a single upstream when they are tried in turn
+	upstreamAttemptTimeout = 2 * time.Second
+	// upstreamFailThreshold consecutive failures mark the upstream unhealthy for upstreamCooldown
+	upstreamFailThreshold = 3
+	upstreamCooldown      = 30 * time.Second
+	// the weight of the latest latency in the moving average
+	latencyAlpha = 0.3
+)
+
+// Upstream is a nameserver with its health statistics
+type Upstream struct {
+	dnsClient
+
+	queries  *atomic.Int64
+	errors   *atomic.Int64
+	timeouts *atomic.Int64
+	failures *atomic.Int64
+
+	mux         sync.RWMutex
+	latency     time.Duration
+	lastError   string
+	lastFailure time.Time
+}
+
+func (u *Upstream) Exchange(m *dns.Msg) (msg *dns.Msg, err error) {
+	return u.ExchangeContext(context.Background(), m)
+}
+
+func (u *Upstream) ExchangeContext(ctx context.Context, m *dns.Msg) (msg *dns.Msg, err error) {
+	start := time.Now()
+	msg, err = u.dnsClient.ExchangeContext(ctx, m)
+	// lost the race of parallel exchange, not the fault of upstream
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+
+	u.queries.Inc()
+	if err == nil && msg.Rcode != dns.RcodeServerFailure && msg.Rcode != dns.RcodeRefused {
+		u.failures.Store(0)
+		u.mux.Lock()
+		elapsed := time.Since(start)
+		if u.latency == 0 {
+			u.latency = elapsed
+		} else {
+			u.latency = time.Duration(latencyAlpha*float64(elapsed) + (1-latencyAlpha)*float64(u.latency))
+		}
+		u.mux.Unlock()
+		return
+	}
+
+	u.errors.Inc()
+	u.failures.Inc()
+	if isTimeout(ctx, err) {
+		u.timeouts.Inc()
+	}
+	reason := "server failure"
+	if err != nil {
+		reason = err.Error()
+	}
+	u.mux.Lock()
+	u.lastError = reason
+	u.lastFailure = time.Now()
+	u.mux.Unlock()
+	return
+}
+
+// Healthy return false if the upstream failed continuously recently
+func (u *Upstream) Healthy() bool {
+	if u.failures.Load() < upstreamFailThreshold {
+		return true
+	}
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+	return time.Since(u.lastFailure) > upstreamCooldown
+}
+
+// score is used to rank the upstreams, lower is better.
+// the upstream never measured is tried first
+func (u *Upstream) score() time.Duration {
+	u.mux.RLock()
+	latency := u.latency
+	u.mux.RUnlock()
+	if !u.Healthy() {
+		return latency + time.Hour
+	}
+	return latency
+}
+
+// MarshalJSON implements json.Marshaler
+func (u *Upstream) MarshalJSON() ([]byte, error) {
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+
+	queries, errs := u.queries.Load(), u.errors.Load()
+	var errorRate float64
+	if queries != 0 {
+		errorRate = float64(errs) / float64(queries)
+	}
+	mapping := map[string]any{
+		"address":   u.Address(),
+		"queries":   queries,
+		"errors":    errs,
+		"timeouts":  u.timeouts.Load(),
+		"errorRate": errorRate,
+		"latency":   u.latency.Milliseconds(),
+		"healthy":   u.failures.Load() < upstreamFailThreshold || time.Since(u.lastFailure) > upstreamCooldown,
+	}
+	if u.lastError != "" {
+		mapping["lastError"] = u.lastError
+		mapping["lastFailure"] = u.lastFailure
+	}
+	return json.Marshal(mapping)
+}
+
+func isTimeout(ctx context.Context, err error) bool {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func newUpstreams(clients []dnsClient) []dnsClient {
+	ret := make([]dnsClient, 0, len(clients))
+	for _, c := range clients {
+		ret = append(ret, &Upstream{
+			dnsClient: c,
+			queries:   atomic.NewInt64(0),
+			errors:    atomic.NewInt64(0),
+			timeouts:  atomic.NewInt64(0),
+			failures:  atomic.NewInt64(0),
+		})
+	}
+	return ret
+}
+
+// Upstreams return the nameservers with health statistics
+func (r *Resolver) Upstreams() []*Upstream {
+	var ret []*Upstream
+	for _, clients := range [][]dnsClient{r.main, r.localClients()} {
+		for _, c := range clients {
+			if u, ok := c.(*Upstream); ok {
+				ret = append(ret, u)
+			}
+		}
+	}
+	return ret
+}
+
+// Strategy return how the upstreams are selected
+func (r *Resolver) Strategy() string {
+	return r.strategy
+}
+
+// exchangeByStrategy send the query to the upstreams selected by the strategy
+func (r *Resolver) exchangeByStrategy(ctx context.Context, clients []dnsClient, m *dns.Msg) (*dns.Msg, error) {
+	if len(clients) <= 1 {
+		return batchExchange(ctx, clients, m)
+	}
+
+	switch r.strategy {
+	case StrategyFastestN:
+		ranked := rankUpstreams(clients)
+		n := r.fastestN
+		if n <= 0 || n > len(ranked) {
+			n = len(ranked)
+		}
+		msg, err := batchExchange(ctx, ranked[:n], m)
+		if err == nil || n == len(ranked) || ctx.Err() != nil {
+			return msg, err
+		}
+		// the fastest failed, fall back to the others
+		return batchExchange(ctx, ranked[n:], m)
+	case StrategyRoundRobin:
+		start := int(r.rrIndex.Inc() % uint64(len(clients)))
+		ordered := append(append([]dnsClient{}, clients[start:]...), clients[:start]...)
+		return sequentialExchange(ctx, ordered, m)
+	case StrategySequential:
+		// the unhealthy are tried at last
+		ordered := make([]dnsClient, 0, len(clients))
+		var unhealthy []dnsClient
+		for _, c := range clients {
+			if u, ok := c.(*Upstream); ok && !u.Healthy() {
+				unhealthy = append(unhealthy, c)
+				continue
+			}
+			ordered = append(ordered, c)
+		}
+		return sequentialExchange(ctx, append(ordered, unhealthy...), m)
+	default:
+		return batchExchange(ctx, clients, m)
+	}
+}
+
+// sequentialExchange try the upstreams in turn until one answers
+func sequentialExchange(ctx context.Context, clients []dnsClient, m *dns.Msg) (msg *dns.Msg, err error) {
+	var errs []string
+	for _, c := range clients {
+		attemptCtx, cancel := context.WithTimeout(ctx, upstreamAttemptTimeout)
+		msg, err = batchExchange(attemptCtx, []dnsClient{c}, m)
+		cancel()
+		if err == nil {
+			return msg, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", c.Address(), err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("all DNS requests failed: %s", strings.Join(errs, "; "))
+}
+
+func rankUpstreams(clients []dnsClient) []dnsClient {
+	ranked := append([]dnsClient{}, clients...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		ui, okI := ranked[i].(*Upstream)
+		uj, okJ := ranked[j].(*Upstream)
+		if !okI || !okJ {
+			return okJ
+		}
+		return ui.score() < uj.score()
+	})
+	return ranked
+}
+
+func ParseStrategy(strategy string) (string, error) {
+	switch strings.ToLower(strategy) {
+	case "", StrategyParallelAll:
+		return StrategyParallelAll, nil
+	case StrategyFastestN, StrategyRoundRobin, StrategySequential:
+		return strings.ToLower(strategy), nil
+	default:
+		return "", fmt.Errorf("unsupport strategy: %s", strategy)
+	}
+}
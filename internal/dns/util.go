@@ -6,30 +6,16 @@ import (
 	"errors"
 	"fmt"
 	"github.com/miekg/dns"
-	"github.com/sirupsen/logrus"
-	"github.com/xmapst/mixed-socks/internal/common/cache"
 	"github.com/xmapst/mixed-socks/internal/common/picker"
+	"github.com/xmapst/mixed-socks/internal/component/dialer"
+	"github.com/xmapst/mixed-socks/internal/component/resolver"
+	"github.com/xmapst/mixed-socks/internal/constant"
+	icontext "github.com/xmapst/mixed-socks/internal/context"
+	"github.com/xmapst/mixed-socks/internal/tunnel"
 	"net"
 	"time"
 )
 
-func putMsgToCache(c *cache.LruCache, key string, msg *dns.Msg) {
-	var ttl uint32
-	switch {
-	case len(msg.Answer) != 0:
-		ttl = msg.Answer[0].Header().Ttl
-	case len(msg.Ns) != 0:
-		ttl = msg.Ns[0].Header().Ttl
-	case len(msg.Extra) != 0:
-		ttl = msg.Extra[0].Header().Ttl
-	default:
-		logrus.Debugln("[DNS] response msg empty: %#v", msg)
-		return
-	}
-
-	c.SetWithExpire(key, msg.Copy(), time.Now().Add(time.Second*time.Duration(ttl)))
-}
-
 func setMsgTTL(msg *dns.Msg, ttl uint32) {
 	for _, answer := range msg.Answer {
 		answer.Header().Ttl = ttl
@@ -48,35 +34,98 @@ func isIPRequest(q dns.Question) bool {
 	return q.Qclass == dns.ClassINET && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA)
 }
 
+func isIPVersionDisabled(q dns.Question) bool {
+	switch q.Qtype {
+	case dns.TypeA:
+		return !resolver.GetIPPreference().IPv4Enabled()
+	case dns.TypeAAAA:
+		return !resolver.GetIPPreference().IPv6Enabled()
+	default:
+		return false
+	}
+}
+
+func nameServerAddress(s NameServer) string {
+	scheme := "udp"
+	switch s.Net {
+	case "tcp":
+		scheme = "tcp"
+	case "tcp-tls":
+		scheme = "tls"
+	case "https", "dhcp":
+		return s.Net + "://" + s.Addr
+	}
+	return scheme + "://" + s.Addr
+}
+
 func transform(servers []NameServer, resolver *Resolver) []dnsClient {
 	var ret []dnsClient
 	for _, s := range servers {
-		switch s.Net {
-		case "https":
-			ret = append(ret, newDoHClient(s.Addr, s.Interface, resolver))
-			continue
-		case "dhcp":
-			ret = append(ret, newDHCPClient(s.Addr))
-			continue
+		c := transformOne(s, resolver)
+		if s.ECS != nil {
+			c = &ecsClient{dnsClient: c, ecs: s.ECS}
 		}
+		ret = append(ret, c)
+	}
+	return ret
+}
 
-		host, port, _ := net.SplitHostPort(s.Addr)
-		ret = append(ret, &client{
-			Client: &dns.Client{
-				Net: s.Net,
-				TLSConfig: &tls.Config{
-					ServerName: host,
-				},
-				UDPSize: 4096,
-				Timeout: 5 * time.Second,
+func transformOne(s NameServer, resolver *Resolver) dnsClient {
+	switch s.Net {
+	case "https":
+		return newDoHClient(s.Addr, s.Interface, s.ProxyAdapter, resolver)
+	case "dhcp":
+		return newDHCPClient(s.Addr)
+	}
+
+	host, port, _ := net.SplitHostPort(s.Addr)
+	dnsNet := s.Net
+	if s.ProxyAdapter != "" && dnsNet == "" {
+		// upstream proxies relay streams only, so plain dns goes over tcp
+		dnsNet = "tcp"
+	}
+	return &client{
+		addr: nameServerAddress(s),
+		Client: &dns.Client{
+			Net: dnsNet,
+			TLSConfig: &tls.Config{
+				ServerName: host,
 			},
-			port:  port,
-			host:  host,
-			iface: s.Interface,
-			r:     resolver,
-		})
+			UDPSize: 4096,
+			Timeout: 5 * time.Second,
+		},
+		port:         port,
+		host:         host,
+		iface:        s.Interface,
+		proxyAdapter: s.ProxyAdapter,
+		r:            resolver,
 	}
-	return ret
+}
+
+// dialContextExtra dial the upstream directly, or through the named proxy adapter
+func dialContextExtra(ctx context.Context, proxyAdapter, network, host string, ip net.IP, port string, opts ...dialer.Option) (net.Conn, error) {
+	if proxyAdapter == "" {
+		if ip == nil {
+			return nil, fmt.Errorf("%w: %s", resolver.ErrIPNotFound, host)
+		}
+		return dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port), opts...)
+	}
+
+	proxy, exist := tunnel.Proxies()[proxyAdapter]
+	if !exist {
+		return nil, fmt.Errorf("proxy %s not found", proxyAdapter)
+	}
+
+	metadata := &constant.Metadata{
+		NetWork: constant.TCP,
+		Host:    host,
+		DstPort: port,
+	}
+	if ip != nil {
+		metadata.Host = ""
+		metadata.DstIP = ip
+	}
+	return proxy.DialContext(ctx, metadata, opts...)
 }
 
 func handleMsgWithEmptyAnswer(r *dns.Msg) *dns.Msg {
@@ -106,17 +155,24 @@ func msgToIP(msg *dns.Msg) []net.IP {
 }
 
 func batchExchange(ctx context.Context, clients []dnsClient, m *dns.Msg) (msg *dns.Msg, err error) {
-	fast, ctx := picker.WithContext(ctx)
+	type answer struct {
+		msg      *dns.Msg
+		upstream string
+	}
+
+	fast, fastCtx := picker.WithContext(ctx)
+	// only the outermost exchange record the upstream
+	fastCtx = withDNSContext(fastCtx, nil)
 	for _, client := range clients {
 		r := client
 		fast.Go(func() (any, error) {
-			m, err := r.ExchangeContext(ctx, m)
+			m, err := r.ExchangeContext(fastCtx, m)
 			if err != nil {
 				return nil, err
 			} else if m.Rcode == dns.RcodeServerFailure || m.Rcode == dns.RcodeRefused {
 				return nil, errors.New("server failure")
 			}
-			return m, nil
+			return &answer{msg: m, upstream: r.Address()}, nil
 		})
 	}
 
@@ -129,6 +185,22 @@ func batchExchange(ctx context.Context, clients []dnsClient, m *dns.Msg) (msg *d
 		return nil, err
 	}
 
-	msg = elm.(*dns.Msg)
-	return
+	ans := elm.(*answer)
+	if dCtx := dnsContextFrom(ctx); dCtx != nil {
+		dCtx.SetUpstream(ans.upstream)
+	}
+	return ans.msg, nil
+}
+
+type dnsContextKey struct{}
+
+// withDNSContext carry the DNSContext of the server request through the resolver,
+// so the resolver can record which upstream answered and whether cache hit
+func withDNSContext(ctx context.Context, dCtx *icontext.DNSContext) context.Context {
+	return context.WithValue(ctx, dnsContextKey{}, dCtx)
+}
+
+func dnsContextFrom(ctx context.Context) *icontext.DNSContext {
+	dCtx, _ := ctx.Value(dnsContextKey{}).(*icontext.DNSContext)
+	return dCtx
 }
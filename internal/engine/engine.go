@@ -3,26 +3,32 @@ package engine
 import (
 	"github.com/sirupsen/logrus"
 	N "github.com/xmapst/mixed-socks/internal/common/net"
+	"github.com/xmapst/mixed-socks/internal/component/accesslog"
 	"github.com/xmapst/mixed-socks/internal/component/auth"
 	"github.com/xmapst/mixed-socks/internal/component/dialer"
 	"github.com/xmapst/mixed-socks/internal/component/iface"
+	"github.com/xmapst/mixed-socks/internal/component/logs"
 	"github.com/xmapst/mixed-socks/internal/component/resolver"
 	"github.com/xmapst/mixed-socks/internal/component/trie"
 	"github.com/xmapst/mixed-socks/internal/config"
+	"github.com/xmapst/mixed-socks/internal/constant"
 	"github.com/xmapst/mixed-socks/internal/controller"
 	"github.com/xmapst/mixed-socks/internal/dns"
 	"github.com/xmapst/mixed-socks/internal/listener"
 	authStore "github.com/xmapst/mixed-socks/internal/listener/auth"
 	"github.com/xmapst/mixed-socks/internal/tunnel"
-	"gopkg.in/natefinch/lumberjack.v2"
-	"io"
+	"github.com/xmapst/mixed-socks/internal/tunnel/statistic"
 	"net"
-	"os"
-	"path/filepath"
 )
 
 // Run call at the beginning of mixed-socks
 func Run() error {
+	history := statistic.DefaultManager.History()
+	history.SetFile(constant.Path.Resolve(trafficHistoryFile))
+	if err := history.Load(); err != nil {
+		logrus.Warnf("restore traffic history failed: %s", err)
+	}
+
 	var changeCh = make(chan bool, 1024)
 	go applyConfig(changeCh)
 
@@ -42,7 +48,10 @@ func Run() error {
 func applyConfig(changeCh chan bool) {
 	for range changeCh {
 		updateOutbound(config.App.Outbound)
+		updateProxies(config.App.Proxies)
+		updateIPPreference(config.App.IPPreference)
 		updateLogger(config.App.Log)
+		updateAccessLog(config.App.Log)
 		updateWhitelist(config.App.Whitelist)
 		updateUsers(config.App.Users)
 		updateHosts(config.App.Hosts)
@@ -51,17 +60,38 @@ func applyConfig(changeCh chan bool) {
 	}
 }
 
-var _fileName string
+const (
+	dnsCacheFile       = "dns-cache.json"
+	trafficHistoryFile = "traffic-history.json"
+)
+
+// Shutdown call at the end of mixed-socks
+func Shutdown() {
+	if err := statistic.DefaultManager.History().Save(); err != nil {
+		logrus.Warnf("save traffic history failed: %s", err)
+	}
+	accesslog.Default.Close()
+	if r, ok := resolver.DefaultResolver.(*dns.Resolver); ok {
+		if err := r.SaveCache(); err != nil {
+			logrus.Warnf("[DNS] save cache failed: %s", err)
+		}
+		r.Close()
+	}
+}
+
+func updateAccessLog(cfg *config.Log) {
+	var access *config.AccessLog
+	if cfg != nil {
+		access = cfg.Access
+	}
+	if err := accesslog.Default.Update(access.Config()); err != nil {
+		logrus.Errorf("[AccessLog] update failed: %s", err)
+	}
+}
 
 func updateLogger(cfg *config.Log) {
 	if cfg == nil {
-		logrus.SetOutput(io.Discard)
-		if cfg.Output != nil {
-			err := cfg.Output.Close()
-			if err != nil {
-				logrus.Warnln(err)
-			}
-		}
+		logs.Discard()
 		return
 	}
 	level, err := logrus.ParseLevel(cfg.Level)
@@ -69,46 +99,59 @@ func updateLogger(cfg *config.Log) {
 		level = logrus.InfoLevel
 	}
 	logrus.SetLevel(level)
-	if cfg.Filename == _fileName {
-		return
+	if err = logs.Apply(cfg.Config()); err != nil {
+		logrus.Errorln(err)
 	}
-	if cfg.Filename != "" && cfg.Filename != "stdout" {
-		err = os.MkdirAll(filepath.Dir(cfg.Filename), 0777)
-		if err != nil {
-			logrus.Errorln(err)
-			return
-		}
-		cfg.Output = &lumberjack.Logger{
-			Filename:   cfg.Filename,
-			MaxBackups: cfg.MaxBackups,
-			MaxSize:    cfg.MaxSize,
-			MaxAge:     cfg.MaxAge,
-			Compress:   cfg.Compress,
-			LocalTime:  true,
-		}
-		logrus.SetOutput(cfg.Output)
-	} else {
-		cfg.Output = nil
-		logrus.SetOutput(os.Stdout)
-	}
-	_fileName = cfg.Filename
 }
 
 func updateDNS(c *config.DNS) {
+	// release the old resolver after the new one take over
+	if old, ok := resolver.DefaultResolver.(*dns.Resolver); ok {
+		defer old.Close()
+	}
+
 	if !c.Enable {
+		// the cache is not reused by the next resolver, keep it for the next start
+		if old, ok := resolver.DefaultResolver.(*dns.Resolver); ok {
+			if err := old.SaveCache(); err != nil {
+				logrus.Warnf("[DNS] save cache failed: %s", err)
+			}
+		}
+		tunnel.UpdateDNSHijack(nil, nil)
+		resolver.DefaultNAT64Prefix = nil
 		resolver.DefaultResolver = nil
 		resolver.DefaultHostMapper = nil
-		dns.ReCreateServer("", nil, nil)
+		dns.ReCreateServer("", nil, nil, nil)
 		return
 	}
 
 	cfg := dns.Config{
 		NameServers: c.NameServers,
+		Strategy:    c.Strategy,
+		FastestN:    c.FastestN,
 		Hosts:       c.Hosts,
+		Blocker:     c.Blocker,
+		Cache:       c.Cache,
+		DNSSEC:      c.DNSSEC,
+		Local:       c.Local,
+		DNS64:       c.DNS64,
+	}
+	if c.PersistCache {
+		cfg.PersistFile = constant.Path.Resolve(dnsCacheFile)
 	}
 
 	r := dns.NewResolver(cfg)
 	m := dns.NewEnhancer()
+	dns.DefaultQueryLog.SetSize(c.QueryLogSize)
+
+	// reuse cache of old resolver, or restore it from the snapshot on startup
+	if old, ok := resolver.DefaultResolver.(*dns.Resolver); ok {
+		r.PatchFrom(old)
+	} else if err := r.LoadCache(); err != nil {
+		logrus.Warnf("[DNS] restore cache failed: %s", err)
+	}
+	// the local and cached block lists are loaded before serving
+	r.StartBlocker()
 
 	// reuse cache of old host mapper
 	if old := resolver.DefaultHostMapper; old != nil {
@@ -117,8 +160,15 @@ func updateDNS(c *config.DNS) {
 
 	resolver.DefaultResolver = r
 	resolver.DefaultHostMapper = m
+	resolver.DefaultNAT64Prefix = c.DNS64
+	tunnel.UpdateDNSHijack(c.Hijack, dns.HandleHijack)
 	addr := N.GenAddr(c.Listen, c.Port)
-	dns.ReCreateServer(addr, r, m)
+	dns.ReCreateServer(addr, r, m, c.ACL)
+}
+
+func updateIPPreference(preference resolver.IPPreference) {
+	resolver.SetIPPreference(preference)
+	logrus.Infof("ip preference: %s", preference)
 }
 
 func updateHosts(tree *trie.DomainTrie) {
@@ -139,6 +189,10 @@ func updateOutbound(cfg *config.Outbound) {
 	}
 }
 
+func updateProxies(proxies map[string]constant.Proxy) {
+	tunnel.UpdateProxies(proxies)
+}
+
 func updateInbound(cfg *config.Inbound) {
 	iface.FlushCache()
 
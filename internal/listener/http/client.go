@@ -11,7 +11,7 @@ import (
 	"time"
 )
 
-func newClient(source net.Addr, in chan<- constant.ConnContext) *http.Client {
+func newClient(source net.Addr, user *string, in chan<- constant.ConnContext) *http.Client {
 	return &http.Client{
 		Transport: &http.Transport{
 			// from http.DefaultTransport
@@ -31,7 +31,9 @@ func newClient(source net.Addr, in chan<- constant.ConnContext) *http.Client {
 
 				left, right := net.Pipe()
 
-				in <- inbound.NewHTTP(dstAddr, source, right)
+				ctx := inbound.NewHTTP(dstAddr, source, right)
+				ctx.Metadata().User = *user
+				in <- ctx
 
 				return left, nil
 			},
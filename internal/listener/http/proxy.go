@@ -6,6 +6,7 @@ import (
 	"github.com/xmapst/mixed-socks/internal/adapter/inbound"
 	"github.com/xmapst/mixed-socks/internal/common/cache"
 	N "github.com/xmapst/mixed-socks/internal/common/net"
+	"github.com/xmapst/mixed-socks/internal/component/metrics"
 	"github.com/xmapst/mixed-socks/internal/constant"
 	authStore "github.com/xmapst/mixed-socks/internal/listener/auth"
 	"net"
@@ -14,19 +15,26 @@ import (
 )
 
 func HandleConn(c net.Conn, in chan<- constant.ConnContext, cache *cache.LruCache) {
-	client := newClient(c.RemoteAddr(), in)
+	// user is filled once the connection authenticated
+	var user string
+	client := newClient(c.RemoteAddr(), &user, in)
 	defer client.CloseIdleConnections()
 
 	conn := N.NewBufferedConn(c)
 
 	keepAlive := true
 	trusted := cache == nil // disable authenticate if cache is nil
+	handled := false
 
 	for keepAlive {
 		request, err := ReadRequest(conn.Reader())
 		if err != nil {
+			if !handled {
+				metrics.HandshakeFailures.With(constant.HTTP.String(), "malformed").Inc()
+			}
 			break
 		}
+		handled = true
 
 		request.RemoteAddr = conn.RemoteAddr().String()
 
@@ -35,7 +43,7 @@ func HandleConn(c net.Conn, in chan<- constant.ConnContext, cache *cache.LruCach
 		var resp *http.Response
 
 		if !trusted {
-			resp = authenticate(request, cache)
+			resp, user = authenticate(request, cache)
 
 			trusted = resp == nil
 		}
@@ -47,7 +55,9 @@ func HandleConn(c net.Conn, in chan<- constant.ConnContext, cache *cache.LruCach
 					break // close connection
 				}
 
-				in <- inbound.NewHTTPS(request, conn)
+				ctx := inbound.NewHTTPS(request, conn)
+				ctx.Metadata().User = user
+				in <- ctx
 
 				return // hijack connection
 			}
@@ -60,7 +70,7 @@ func HandleConn(c net.Conn, in chan<- constant.ConnContext, cache *cache.LruCach
 			request.RequestURI = ""
 
 			if isUpgradeRequest(request) {
-				handleUpgrade(conn, request, in)
+				handleUpgrade(conn, request, user, in)
 
 				return // hijack connection
 			}
@@ -97,30 +107,33 @@ func HandleConn(c net.Conn, in chan<- constant.ConnContext, cache *cache.LruCach
 	_ = conn.Close()
 }
 
-func authenticate(request *http.Request, cache *cache.LruCache) *http.Response {
+// authenticate return the response if failed, and the user authenticated
+func authenticate(request *http.Request, cache *cache.LruCache) (*http.Response, string) {
 	authenticator := authStore.Authenticator()
 	if authenticator != nil {
 		credential := parseBasicProxyAuthorization(request)
 		if credential == "" {
 			resp := responseWith(request, http.StatusProxyAuthRequired)
 			resp.Header.Set("Proxy-Authenticate", "Basic")
-			return resp
+			return resp, ""
 		}
 
+		user, pass, err := decodeBasicProxyAuthorization(credential)
 		authed, exist := cache.Get(credential)
 		if !exist {
-			user, pass, err := decodeBasicProxyAuthorization(credential)
 			authed = err == nil && authenticator.Verify(user, pass)
 			cache.Set(credential, authed)
 		}
 		if !authed.(bool) {
 			logrus.Infoln("Auth failed from %s", request.RemoteAddr)
+			metrics.AuthFailures.With(constant.HTTP.String()).Inc()
 
-			return responseWith(request, http.StatusForbidden)
+			return responseWith(request, http.StatusForbidden), ""
 		}
+		return nil, user
 	}
 
-	return nil
+	return nil, ""
 }
 
 func responseWith(request *http.Request, statusCode int) *http.Response {
@@ -22,7 +22,7 @@ func isUpgradeRequest(req *http.Request) bool {
 	return false
 }
 
-func handleUpgrade(conn net.Conn, request *http.Request, in chan<- constant.ConnContext) {
+func handleUpgrade(conn net.Conn, request *http.Request, user string, in chan<- constant.ConnContext) {
 	defer func(conn net.Conn) {
 		_ = conn.Close()
 	}(conn)
@@ -42,7 +42,9 @@ func handleUpgrade(conn net.Conn, request *http.Request, in chan<- constant.Conn
 
 	left, right := net.Pipe()
 
-	in <- inbound.NewHTTP(dstAddr, conn.RemoteAddr(), right)
+	ctx := inbound.NewHTTP(dstAddr, conn.RemoteAddr(), right)
+	ctx.Metadata().User = user
+	in <- ctx
 
 	bufferedLeft := N.NewBufferedConn(left)
 	defer func(bufferedLeft *N.BufferedConn) {
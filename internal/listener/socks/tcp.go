@@ -1,7 +1,9 @@
 package socks
 
 import (
+	"errors"
 	"github.com/xmapst/mixed-socks/internal/adapter/inbound"
+	"github.com/xmapst/mixed-socks/internal/component/metrics"
 	"github.com/xmapst/mixed-socks/internal/constant"
 	authStore "github.com/xmapst/mixed-socks/internal/listener/auth"
 	"github.com/xmapst/mixed-socks/internal/transport/socks4"
@@ -33,17 +35,21 @@ func (l *Listener) Close() error {
 }
 
 func HandleSocks4(conn net.Conn, in chan<- constant.ConnContext) {
-	addr, _, err := socks4.ServerHandshake(conn, authStore.Authenticator())
+	addr, _, user, err := socks4.ServerHandshake(conn, authStore.Authenticator())
 	if err != nil {
+		handshakeFailed(constant.SOCKS4, err)
 		_ = conn.Close()
 		return
 	}
-	in <- inbound.NewSocket(socks5.ParseAddr(addr), conn, constant.SOCKS4)
+	ctx := inbound.NewSocket(socks5.ParseAddr(addr), conn, constant.SOCKS4)
+	ctx.Metadata().User = user
+	in <- ctx
 }
 
 func HandleSocks5(conn net.Conn, in chan<- constant.ConnContext) {
-	target, command, err := socks5.ServerHandshake(conn, authStore.Authenticator())
+	target, command, user, err := socks5.ServerHandshake(conn, authStore.Authenticator())
 	if err != nil {
+		handshakeFailed(constant.SOCKS5, err)
 		_ = conn.Close()
 		return
 	}
@@ -54,5 +60,27 @@ func HandleSocks5(conn net.Conn, in chan<- constant.ConnContext) {
 		_, _ = io.Copy(io.Discard, conn)
 		return
 	}
-	in <- inbound.NewSocket(target, conn, constant.SOCKS5)
+	ctx := inbound.NewSocket(target, conn, constant.SOCKS5)
+	ctx.Metadata().User = user
+	in <- ctx
+}
+
+// handshakeFailed record the failure by the reason
+func handshakeFailed(protocol constant.Type, err error) {
+	reason := "protocol"
+	var netErr net.Error
+	switch {
+	case errors.Is(err, socks5.ErrAuth), errors.Is(err, socks4.ErrRequestIdentdMismatched):
+		reason = "auth"
+		metrics.AuthFailures.With(protocol.String()).Inc()
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		reason = "eof"
+	case errors.Is(err, socks5.ErrCommandNotSupported):
+		reason = "command"
+	case errors.Is(err, socks5.ErrAddressNotSupported):
+		reason = "address"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		reason = "timeout"
+	}
+	metrics.HandshakeFailures.With(protocol.String(), reason).Inc()
 }
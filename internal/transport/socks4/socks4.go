@@ -39,7 +39,8 @@ var (
 	ErrRequestUnknownCode      = errors.New("request failed with unknown code")
 )
 
-func ServerHandshake(rw io.ReadWriter, authenticator auth.Authenticator) (addr string, command Command, err error) {
+// ServerHandshake return the userid authenticated, empty if auth disabled
+func ServerHandshake(rw io.ReadWriter, authenticator auth.Authenticator) (addr string, command Command, user string, err error) {
 	var req [8]byte
 	if _, err = io.ReadFull(rw, req[:]); err != nil {
 		return
@@ -86,8 +87,11 @@ func ServerHandshake(rw io.ReadWriter, authenticator auth.Authenticator) (addr s
 	}
 
 	// SOCKS4 only support USERID auth.
-	if authenticator == nil || authenticator.Verify(string(userID), "") {
+	if authenticator == nil {
 		code = RequestGranted
+	} else if authenticator.Verify(string(userID), "") {
+		code = RequestGranted
+		user = string(userID)
 	} else {
 		code = RequestIdentdMismatched
 		err = ErrRequestIdentdMismatched
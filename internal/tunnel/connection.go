@@ -5,8 +5,11 @@ import (
 	N "github.com/xmapst/mixed-socks/internal/common/net"
 	"github.com/xmapst/mixed-socks/internal/common/pool"
 	"github.com/xmapst/mixed-socks/internal/constant"
+	"github.com/xmapst/mixed-socks/internal/tunnel/statistic"
+	"io"
 	"net"
 	"net/netip"
+	"os"
 	"time"
 )
 
@@ -27,13 +30,13 @@ func handleUDPToRemote(packet constant.UDPPacket, pc constant.PacketConn, metada
 	return nil
 }
 
-func handleUDPToLocal(packet constant.UDPPacket, pc net.PacketConn, key string, oAddr netip.Addr) {
+func handleUDPToLocal(packet constant.UDPPacket, pc constant.PacketConn, key string, oAddr netip.Addr) {
 	buf := pool.Get(pool.UDPBufferSize)
 	defer func(buf []byte) {
 		_ = pool.Put(buf)
 	}(buf)
-	defer natTable.Delete(key)
-	defer func(pc net.PacketConn) {
+	defer natTable.DeleteIf(key, pc)
+	defer func(pc constant.PacketConn) {
 		_ = pc.Close()
 	}(pc)
 
@@ -53,5 +56,54 @@ func handleUDPToLocal(packet constant.UDPPacket, pc net.PacketConn, key string,
 }
 
 func handleSocket(ctx constant.ConnContext, outbound net.Conn) {
-	N.Relay(ctx.Conn(), outbound)
+	reason := relay(ctx.Conn(), outbound)
+	if t, ok := outbound.(*statistic.TcpTracker); ok {
+		t.SetReason(reason)
+	}
+}
+
+// sideReader remember the read error, to tell which side of the relay failed
+type sideReader struct {
+	io.Reader
+	err error
+}
+
+func (r *sideReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// relay copies between client and remote bidirectionally like N.Relay,
+// return the close reason by the direction finished first
+func relay(client, remote net.Conn) string {
+	ch := make(chan string, 1)
+
+	go func() {
+		reader := &sideReader{Reader: remote}
+		_, _ = io.Copy(N.WriteOnlyWriter{Writer: client}, reader)
+		_ = client.SetReadDeadline(time.Now())
+		// the remote closed, or the client can't be written
+		reason := statistic.ReasonRemoteClosed
+		if reader.err == nil {
+			reason = statistic.ReasonClientClosed
+		}
+		ch <- reason
+	}()
+
+	reader := &sideReader{Reader: client}
+	_, _ = io.Copy(N.WriteOnlyWriter{Writer: remote}, reader)
+	_ = remote.SetReadDeadline(time.Now())
+	// the other direction finished first and set the deadline
+	if errors.Is(reader.err, os.ErrDeadlineExceeded) {
+		return <-ch
+	}
+	<-ch
+	// the client closed or half-closed, or the remote can't be written
+	if reader.err == nil {
+		return statistic.ReasonRemoteClosed
+	}
+	return statistic.ReasonClientClosed
 }
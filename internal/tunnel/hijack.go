@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/mixed-socks/internal/adapter/inbound"
+	"github.com/xmapst/mixed-socks/internal/constant"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// dnsTCPIdleTimeout close the idle hijacked dns over tcp connection
+const dnsTCPIdleTimeout = 10 * time.Second
+
+// DNSHandler answer the dns query in wire format
+type DNSHandler func(local, remote net.Addr, query []byte) ([]byte, error)
+
+// HijackRule match the destination of dns traffic, nil IP means any address
+type HijackRule struct {
+	IP   net.IP
+	Port string
+}
+
+var (
+	hijackRules   []HijackRule
+	hijackHandler DNSHandler
+	hijackMux     sync.RWMutex
+)
+
+// UpdateDNSHijack handle update the dns hijack rules, empty rules means disabled
+func UpdateDNSHijack(rules []HijackRule, handler DNSHandler) {
+	hijackMux.Lock()
+	defer hijackMux.Unlock()
+	hijackRules = rules
+	hijackHandler = handler
+}
+
+// shouldHijack return the handler if the destination matches the hijack rules
+func shouldHijack(metadata *constant.Metadata) DNSHandler {
+	hijackMux.RLock()
+	defer hijackMux.RUnlock()
+
+	if hijackHandler == nil {
+		return nil
+	}
+	for _, rule := range hijackRules {
+		if rule.Port != metadata.DstPort {
+			continue
+		}
+		if rule.IP == nil || rule.IP.Equal(metadata.DstIP) {
+			return hijackHandler
+		}
+	}
+	return nil
+}
+
+func hijackUDP(packet *inbound.PacketAdapter, metadata *constant.Metadata, handler DNSHandler) {
+	defer packet.Drop()
+
+	local, remote := hijackAddrs(metadata)
+	msg, err := handler(local, remote, packet.Data())
+	if err != nil {
+		logrus.Debugf("[DNS Hijack] %s --> %s error: %s", metadata.SourceAddress(), metadata.RemoteAddress(), err)
+		return
+	}
+	// reply from the resolver the client sent to
+	_, _ = packet.WriteBack(msg, metadata.UDPAddr())
+}
+
+func hijackTCP(conn net.Conn, metadata *constant.Metadata, handler DNSHandler) {
+	udpLocal, udpRemote := hijackAddrs(metadata)
+	// the tcp address tells the handler the query came over tcp
+	local := &net.TCPAddr{IP: udpLocal.IP, Port: udpLocal.Port}
+	remote := &net.TCPAddr{IP: udpRemote.IP, Port: udpRemote.Port}
+
+	// the messages are prefixed with two bytes length (RFC 1035 section 4.2.2)
+	var length [2]byte
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(dnsTCPIdleTimeout))
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		msg, err := handler(local, remote, query)
+		if err != nil {
+			logrus.Debugf("[DNS Hijack] %s --> %s error: %s", metadata.SourceAddress(), metadata.RemoteAddress(), err)
+			return
+		}
+		buf := make([]byte, 2+len(msg))
+		binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+		copy(buf[2:], msg)
+		if _, err = conn.Write(buf); err != nil {
+			return
+		}
+	}
+}
+
+func hijackAddrs(metadata *constant.Metadata) (local, remote *net.UDPAddr) {
+	dstPort, _ := strconv.Atoi(metadata.DstPort)
+	srcPort, _ := strconv.Atoi(metadata.SrcPort)
+	return &net.UDPAddr{IP: metadata.DstIP, Port: dstPort}, &net.UDPAddr{IP: metadata.SrcIP, Port: srcPort}
+}
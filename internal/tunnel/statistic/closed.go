@@ -0,0 +1,185 @@
+package statistic
+
+import (
+	"errors"
+	"github.com/gofrs/uuid"
+	"github.com/xmapst/mixed-socks/internal/component/accesslog"
+	"github.com/xmapst/mixed-socks/internal/constant"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	ReasonClientClosed = "client closed"
+	ReasonRemoteClosed = "remote closed"
+	ReasonIdleTimeout  = "idle timeout"
+	ReasonAPI          = "api"
+	ReasonDialError    = "dial error"
+
+	// closedCapacity is the recently closed connections kept
+	closedCapacity = 1024
+	// directRule is the routing decision of every connection, there are no routing rules
+	directRule = "direct"
+)
+
+// ClosedConnection is a finished connection, or a dial never connected
+type ClosedConnection struct {
+	ID       string             `json:"id"`
+	Metadata *constant.Metadata `json:"metadata"`
+	Chain    constant.Chain     `json:"chains"`
+	Upload   int64              `json:"upload"`
+	Download int64              `json:"download"`
+	Start    time.Time          `json:"start"`
+	End      time.Time          `json:"end"`
+	Duration time.Duration      `json:"duration"`
+	Reason   string             `json:"reason"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// accessRecord return the record of access log
+func (c *ClosedConnection) accessRecord() *accesslog.Record {
+	record := &accesslog.Record{
+		Start:       c.Start,
+		End:         c.End,
+		Inbound:     c.Metadata.Type.String(),
+		Network:     c.Metadata.NetWork.String(),
+		User:        c.Metadata.User,
+		Client:      c.Metadata.SourceAddress(),
+		Host:        c.Metadata.Host,
+		Port:        c.Metadata.DstPort,
+		Rule:        directRule,
+		Chain:       c.Chain.String(),
+		Upload:      c.Upload,
+		Download:    c.Download,
+		DurationMs:  c.Duration.Milliseconds(),
+		CloseReason: c.Reason,
+		Error:       c.Error,
+	}
+	if c.Metadata.DstIP != nil {
+		record.IP = c.Metadata.DstIP.String()
+	}
+	return record
+}
+
+// closedRing keep the last closedCapacity closed connections
+type closedRing struct {
+	mux     sync.Mutex
+	entries []*ClosedConnection
+	next    int
+}
+
+func (r *closedRing) push(c *ClosedConnection) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if len(r.entries) < closedCapacity {
+		r.entries = append(r.entries, c)
+		return
+	}
+	r.entries[r.next] = c
+	r.next = (r.next + 1) % closedCapacity
+}
+
+// list return the entries, the latest first
+func (r *closedRing) list() []*ClosedConnection {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	ret := make([]*ClosedConnection, 0, len(r.entries))
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		ret = append(ret, r.entries[(r.next+i)%len(r.entries)])
+	}
+	return ret
+}
+
+// SetReason set why the connection is closing, the first reason wins
+func (t *trackerInfo) SetReason(reason string) {
+	t.reason.CompareAndSwap("", reason)
+}
+
+// readFailed set the reason of udp by the read error of the remote,
+// the reason of tcp is set by the relay which knows the side closed first
+func (t *trackerInfo) readFailed(err error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		t.SetReason(ReasonIdleTimeout)
+	default:
+		t.SetReason(ReasonRemoteClosed)
+	}
+}
+
+func (t *trackerInfo) closed() *ClosedConnection {
+	t.SetReason(ReasonClientClosed)
+	end := time.Now()
+	return &ClosedConnection{
+		ID:       t.UUID.String(),
+		Metadata: t.Metadata,
+		Chain:    t.Chain,
+		Upload:   t.UploadTotal.Load(),
+		Download: t.DownloadTotal.Load(),
+		Start:    t.Start,
+		End:      end,
+		Duration: end.Sub(t.Start),
+		Reason:   t.reason.Load(),
+	}
+}
+
+// DialFailed record the dial never connected
+func (m *Manager) DialFailed(metadata *constant.Metadata, start time.Time, err error) {
+	v4, _ := uuid.NewV4()
+	end := time.Now()
+	m.finished(&ClosedConnection{
+		ID:       v4.String(),
+		Metadata: metadata,
+		Chain:    constant.Chain{},
+		Start:    start,
+		End:      end,
+		Duration: end.Sub(start),
+		Reason:   ReasonDialError,
+		Error:    err.Error(),
+	})
+}
+
+// finished keep the connection in the ring and write it to the access log
+func (m *Manager) finished(c *ClosedConnection) {
+	m.closed.push(c)
+	accesslog.Default.Log(c.accessRecord())
+}
+
+// CloseWithReason close the connection of id, return false if not found
+func (m *Manager) CloseWithReason(id, reason string) bool {
+	value, ok := m.connections.Load(id)
+	if !ok {
+		return false
+	}
+	c := value.(tracker)
+	c.info().SetReason(reason)
+	_ = c.Close()
+	return true
+}
+
+// Closed return the recently closed connections match the query, the latest first.
+// Matched is the count before paginated, the sort of query is ignored
+func (m *Manager) Closed(q *ConnectionQuery) ([]*ClosedConnection, int) {
+	var matched []*ClosedConnection
+	for _, c := range m.closed.list() {
+		if q == nil || q.match(c.Metadata, c.Chain) {
+			matched = append(matched, c)
+		}
+	}
+	total := len(matched)
+	if q == nil {
+		return matched, total
+	}
+	if q.Offset > 0 {
+		if q.Offset >= len(matched) {
+			matched = matched[:0]
+		} else {
+			matched = matched[q.Offset:]
+		}
+	}
+	if q.Limit > 0 && q.Limit < len(matched) {
+		matched = matched[:q.Limit]
+	}
+	return matched, total
+}
@@ -0,0 +1,309 @@
+package statistic
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ResolutionSecond = "second"
+	ResolutionMinute = "minute"
+	ResolutionHour   = "hour"
+
+	// historySaveInterval is the interval of saving the history to file
+	historySaveInterval = 5 * time.Minute
+)
+
+type resolution struct {
+	name   string
+	step   time.Duration
+	window time.Duration
+}
+
+var resolutions = []resolution{
+	{name: ResolutionSecond, step: time.Second, window: 5 * time.Minute},
+	{name: ResolutionMinute, step: time.Minute, window: 24 * time.Hour},
+	{name: ResolutionHour, step: time.Hour, window: 30 * 24 * time.Hour},
+}
+
+// Sample is the traffic of a bucket, Time is the start of it in unix seconds
+type Sample struct {
+	Time int64 `json:"time"`
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+}
+
+// rollup aggregate the traffic in buckets of every resolution,
+// the buckets without traffic are omitted
+type rollup struct {
+	// the traffic since last tick
+	up   *atomic.Int64
+	down *atomic.Int64
+	// the samples by resolution name, in time order
+	series map[string][]Sample
+	// refs is the live trackers pushing to the rollup
+	refs *atomic.Int64
+}
+
+func (r *rollup) push(up, down int64) {
+	r.up.Add(up)
+	r.down.Add(down)
+}
+
+func (r *rollup) add(now time.Time, up, down int64) {
+	for _, res := range resolutions {
+		samples := r.series[res.name]
+		bucket := now.Truncate(res.step).Unix()
+		if n := len(samples); n != 0 && samples[n-1].Time == bucket {
+			samples[n-1].Up += up
+			samples[n-1].Down += down
+		} else if up != 0 || down != 0 {
+			samples = append(samples, Sample{Time: bucket, Up: up, Down: down})
+		}
+
+		// drop the samples out of the window
+		expire := now.Add(-res.window).Unix()
+		idx := 0
+		for idx < len(samples) && samples[idx].Time <= expire {
+			idx++
+		}
+		r.series[res.name] = samples[idx:]
+	}
+}
+
+// idle return whether the rollup has no samples in the windows and no tracker uses it
+func (r *rollup) idle() bool {
+	if r.refs.Load() != 0 || r.up.Load() != 0 || r.down.Load() != 0 {
+		return false
+	}
+	for _, samples := range r.series {
+		if len(samples) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func newRollup() *rollup {
+	return &rollup{
+		up:     atomic.NewInt64(0),
+		down:   atomic.NewInt64(0),
+		series: map[string][]Sample{},
+		refs:   atomic.NewInt64(0),
+	}
+}
+
+// History keep the traffic of the last 5 minutes per second, 24 hours per minute
+// and 30 days per hour, globally and per user and outbound
+type History struct {
+	mux       sync.RWMutex
+	global    *rollup
+	users     map[string]*rollup
+	outbounds map[string]*rollup
+	file      string
+}
+
+// rollups return the rollups of user and outbound, created if not exist.
+// they are kept until released by releaseRollups
+func (h *History) rollups(user, outbound string) []*rollup {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	var ret []*rollup
+	get := func(m map[string]*rollup, key string) {
+		if key == "" {
+			return
+		}
+		r, ok := m[key]
+		if !ok {
+			r = newRollup()
+			m[key] = r
+		}
+		r.refs.Inc()
+		ret = append(ret, r)
+	}
+	get(h.users, user)
+	get(h.outbounds, outbound)
+	return ret
+}
+
+func releaseRollups(rollups []*rollup) {
+	for _, r := range rollups {
+		r.refs.Dec()
+	}
+}
+
+// prune remove the users and outbounds without traffic in the longest window,
+// the caller must hold the lock
+func (h *History) prune() {
+	for _, m := range []map[string]*rollup{h.users, h.outbounds} {
+		for key, r := range m {
+			if r.idle() {
+				delete(m, key)
+			}
+		}
+	}
+}
+
+// tick add the traffic of the last second
+func (h *History) tick(now time.Time, up, down int64) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.global.add(now, up, down)
+	for _, m := range []map[string]*rollup{h.users, h.outbounds} {
+		for _, r := range m {
+			r.add(now, r.up.Swap(0), r.down.Swap(0))
+		}
+	}
+}
+
+// Samples return the samples of the resolution, of the user or outbound if not empty
+func (h *History) Samples(res, user, outbound string) ([]Sample, error) {
+	valid := false
+	for _, r := range resolutions {
+		valid = valid || r.name == res
+	}
+	if !valid {
+		return nil, fmt.Errorf("unsupport resolution: %s", res)
+	}
+
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+
+	r := h.global
+	switch {
+	case user != "":
+		r = h.users[user]
+	case outbound != "":
+		r = h.outbounds[outbound]
+	}
+	if r == nil {
+		return []Sample{}, nil
+	}
+	return append([]Sample{}, r.series[res]...), nil
+}
+
+// Keys return the users and outbounds have history
+func (h *History) Keys() (users []string, outbounds []string) {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+
+	users, outbounds = []string{}, []string{}
+	for user := range h.users {
+		users = append(users, user)
+	}
+	for outbound := range h.outbounds {
+		outbounds = append(outbounds, outbound)
+	}
+	sort.Strings(users)
+	sort.Strings(outbounds)
+	return
+}
+
+type historySnapshot struct {
+	Version   int                            `json:"version"`
+	Global    map[string][]Sample            `json:"global"`
+	Users     map[string]map[string][]Sample `json:"users"`
+	Outbounds map[string]map[string][]Sample `json:"outbounds"`
+}
+
+// SetFile set the file the history persisted to, empty means not persisted
+func (h *History) SetFile(file string) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.file = file
+}
+
+// Save write the history to file
+func (h *History) Save() error {
+	h.mux.Lock()
+	h.prune()
+	file := h.file
+	snapshot := historySnapshot{
+		Version:   1,
+		Global:    h.global.series,
+		Users:     map[string]map[string][]Sample{},
+		Outbounds: map[string]map[string][]Sample{},
+	}
+	for user, r := range h.users {
+		snapshot.Users[user] = r.series
+	}
+	for outbound, r := range h.outbounds {
+		snapshot.Outbounds[outbound] = r.series
+	}
+	buf, err := json.Marshal(snapshot)
+	h.mux.Unlock()
+	if err != nil || file == "" {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	// write to a temp file first, never leave a broken history
+	tmp := file + ".tmp"
+	if err = os.WriteFile(tmp, buf, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Load restore the history from file
+func (h *History) Load() error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.file == "" {
+		return nil
+	}
+
+	buf, err := os.ReadFile(h.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	snapshot := historySnapshot{}
+	if err = json.Unmarshal(buf, &snapshot); err != nil {
+		return err
+	}
+
+	// the rollups in use are kept, the live trackers are pushing to them
+	restore := func(r *rollup, series map[string][]Sample) *rollup {
+		if r == nil {
+			r = newRollup()
+		}
+		for name, samples := range series {
+			r.series[name] = samples
+		}
+		// drop the expired samples
+		r.add(time.Now(), 0, 0)
+		return r
+	}
+	h.global = restore(h.global, snapshot.Global)
+	for user, series := range snapshot.Users {
+		h.users[user] = restore(h.users[user], series)
+	}
+	for outbound, series := range snapshot.Outbounds {
+		h.outbounds[outbound] = restore(h.outbounds[outbound], series)
+	}
+	h.prune()
+	logrus.Infof("restored traffic history from %s", h.file)
+	return nil
+}
+
+func NewHistory() *History {
+	return &History{
+		global:    newRollup(),
+		users:     map[string]*rollup{},
+		outbounds: map[string]*rollup{},
+	}
+}
@@ -1,6 +1,9 @@
 package statistic
 
 import (
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/mixed-socks/internal/component/metrics"
+	"github.com/xmapst/mixed-socks/internal/constant"
 	"go.uber.org/atomic"
 	"sync"
 	"time"
@@ -16,9 +19,19 @@ func init() {
 		downloadBlip:  atomic.NewInt64(0),
 		uploadTotal:   atomic.NewInt64(0),
 		downloadTotal: atomic.NewInt64(0),
+		history:       NewHistory(),
+		top:           NewTopTalkers(),
+		closed:        &closedRing{},
 	}
 
 	go DefaultManager.handle()
+
+	metrics.Register(metrics.NewGaugeFunc("connections_active", "Connections in progress by network.",
+		func(observe func(v float64, values ...string)) {
+			tcp, udp := DefaultManager.Active()
+			observe(float64(tcp), constant.TCP.String())
+			observe(float64(udp), constant.UDP.String())
+		}, "network"))
 }
 
 type Manager struct {
@@ -29,14 +42,30 @@ type Manager struct {
 	downloadBlip  *atomic.Int64
 	uploadTotal   *atomic.Int64
 	downloadTotal *atomic.Int64
+	history       *History
+	top           *TopTalkers
+	closed        *closedRing
 }
 
 func (m *Manager) Join(c tracker) {
 	m.connections.Store(c.ID(), c)
+	m.top.add(c.info().Metadata, 0, 1)
 }
 
 func (m *Manager) Leave(c tracker) {
-	m.connections.Delete(c.ID())
+	// closed more than once
+	if _, loaded := m.connections.LoadAndDelete(c.ID()); !loaded {
+		return
+	}
+	info := c.info()
+	releaseRollups(info.rollups)
+	m.top.add(info.Metadata, info.pending.Swap(0), 0)
+	m.finished(info.closed())
+}
+
+// TopTalkers return the heavy hitters of closed and live connections
+func (m *Manager) TopTalkers() *TopTalkers {
+	return m.top
 }
 
 func (m *Manager) PushUploaded(size int64) {
@@ -49,10 +78,28 @@ func (m *Manager) PushDownloaded(size int64) {
 	m.downloadTotal.Add(size)
 }
 
+// History return the rolling aggregates of traffic
+func (m *Manager) History() *History {
+	return m.history
+}
+
 func (m *Manager) Now() (up int64, down int64) {
 	return m.uploadBlip.Load(), m.downloadBlip.Load()
 }
 
+// Active return the count of tcp and udp connections in progress
+func (m *Manager) Active() (tcp int, udp int) {
+	m.connections.Range(func(key, value any) bool {
+		if _, ok := value.(*UdpTracker); ok {
+			udp++
+		} else {
+			tcp++
+		}
+		return true
+	})
+	return
+}
+
 func (m *Manager) Snapshot() *Snapshot {
 	var connections []tracker
 	m.connections.Range(func(key, value any) bool {
@@ -78,12 +125,24 @@ func (m *Manager) ResetStatistic() {
 
 func (m *Manager) handle() {
 	ticker := time.NewTicker(time.Second)
-
-	for range ticker.C {
-		m.uploadBlip.Store(m.uploadTemp.Load())
-		m.uploadTemp.Store(0)
-		m.downloadBlip.Store(m.downloadTemp.Load())
-		m.downloadTemp.Store(0)
+	lastSave := time.Now()
+
+	for now := range ticker.C {
+		m.uploadBlip.Store(m.uploadTemp.Swap(0))
+		m.downloadBlip.Store(m.downloadTemp.Swap(0))
+		m.history.tick(now, m.uploadBlip.Load(), m.downloadBlip.Load())
+		m.connections.Range(func(key, value any) bool {
+			info := value.(tracker).info()
+			m.top.add(info.Metadata, info.pending.Swap(0), 0)
+			return true
+		})
+
+		if now.Sub(lastSave) >= historySaveInterval {
+			lastSave = now
+			if err := m.history.Save(); err != nil {
+				logrus.Warnf("save traffic history failed: %s", err)
+			}
+		}
 	}
 }
 
@@ -91,4 +150,6 @@ type Snapshot struct {
 	DownloadTotal int64     `json:"downloadTotal"`
 	UploadTotal   int64     `json:"uploadTotal"`
 	Connections   []tracker `json:"connections"`
+	// Matched is the count of connections match the query before paginated
+	Matched int `json:"matched"`
 }
@@ -0,0 +1,238 @@
+package statistic
+
+import (
+	"fmt"
+	"github.com/xmapst/mixed-socks/internal/constant"
+	"net"
+	"sort"
+	"strings"
+)
+
+const (
+	SortByBytes    = "bytes"
+	SortByUpload   = "upload"
+	SortByDownload = "download"
+	SortByAge      = "age"
+)
+
+// ConnectionQuery filter, sort and paginate the connections, empty field match all
+type ConnectionQuery struct {
+	Source *net.IPNet
+	// Host match the substring of host or destination ip
+	Host     string
+	DstPort  string
+	Network  string
+	Type     string
+	User     string
+	Outbound string
+
+	// SortBy is one of bytes, upload, download and age, the largest or oldest first
+	// unless Asc. the connections are not sorted if empty
+	SortBy string
+	Asc    bool
+	Limit  int
+	Offset int
+}
+
+// Match return whether the connection matches the filter
+func (q *ConnectionQuery) Match(t tracker) bool {
+	info := t.info()
+	return q.match(info.Metadata, info.Chain)
+}
+
+func (q *ConnectionQuery) match(metadata *constant.Metadata, chain constant.Chain) bool {
+	if q.Source != nil && !q.Source.Contains(metadata.SrcIP) {
+		return false
+	}
+	if q.Host != "" {
+		host := strings.ToLower(q.Host)
+		if !strings.Contains(strings.ToLower(metadata.Host), host) &&
+			(metadata.DstIP == nil || !strings.Contains(metadata.DstIP.String(), host)) {
+			return false
+		}
+	}
+	if q.DstPort != "" && metadata.DstPort != q.DstPort {
+		return false
+	}
+	if q.Network != "" && !strings.EqualFold(metadata.NetWork.String(), q.Network) {
+		return false
+	}
+	if q.Type != "" && !strings.EqualFold(metadata.Type.String(), q.Type) {
+		return false
+	}
+	if q.User != "" && metadata.User != q.User {
+		return false
+	}
+	if q.Outbound != "" && !strings.EqualFold(chain.String(), q.Outbound) {
+		return false
+	}
+	return true
+}
+
+func (q *ConnectionQuery) sort(connections []tracker) {
+	var less func(a, b *trackerInfo) bool
+	switch q.SortBy {
+	case SortByBytes:
+		less = func(a, b *trackerInfo) bool {
+			return a.UploadTotal.Load()+a.DownloadTotal.Load() < b.UploadTotal.Load()+b.DownloadTotal.Load()
+		}
+	case SortByUpload:
+		less = func(a, b *trackerInfo) bool {
+			return a.UploadTotal.Load() < b.UploadTotal.Load()
+		}
+	case SortByDownload:
+		less = func(a, b *trackerInfo) bool {
+			return a.DownloadTotal.Load() < b.DownloadTotal.Load()
+		}
+	case SortByAge:
+		// the older is larger
+		less = func(a, b *trackerInfo) bool {
+			return a.Start.After(b.Start)
+		}
+	default:
+		return
+	}
+
+	sort.SliceStable(connections, func(i, j int) bool {
+		a, b := connections[i].info(), connections[j].info()
+		if q.Asc {
+			return less(a, b)
+		}
+		return less(b, a)
+	})
+}
+
+// Query return the snapshot of connections match the query,
+// Matched is the count before paginated
+func (m *Manager) Query(q *ConnectionQuery) *Snapshot {
+	snapshot := m.Snapshot()
+	if q == nil {
+		snapshot.Matched = len(snapshot.Connections)
+		return snapshot
+	}
+
+	connections := make([]tracker, 0, len(snapshot.Connections))
+	for _, c := range snapshot.Connections {
+		if q.Match(c) {
+			connections = append(connections, c)
+		}
+	}
+	q.sort(connections)
+	snapshot.Matched = len(connections)
+
+	if q.Offset > 0 {
+		if q.Offset >= len(connections) {
+			connections = connections[:0]
+		} else {
+			connections = connections[q.Offset:]
+		}
+	}
+	if q.Limit > 0 && q.Limit < len(connections) {
+		connections = connections[:q.Limit]
+	}
+	snapshot.Connections = connections
+	return snapshot
+}
+
+// CloseMatched close the connections match the filter of query,
+// the NAT entries of udp are released too. return the count closed
+func (m *Manager) CloseMatched(q *ConnectionQuery) int {
+	closed := 0
+	for _, c := range m.Snapshot().Connections {
+		if q != nil && !q.Match(c) {
+			continue
+		}
+		c.info().SetReason(ReasonAPI)
+		_ = c.Close()
+		closed++
+	}
+	return closed
+}
+
+// ParseSortBy return the valid sort key
+func ParseSortBy(sortBy string) (string, error) {
+	switch strings.ToLower(sortBy) {
+	case "":
+		return "", nil
+	case SortByBytes, SortByUpload, SortByDownload, SortByAge:
+		return strings.ToLower(sortBy), nil
+	default:
+		return "", fmt.Errorf("unsupport sort: %s", sortBy)
+	}
+}
+
+// ConnectionUpdate is the traffic of a connection changed
+type ConnectionUpdate struct {
+	ID       string `json:"id"`
+	Upload   int64  `json:"upload"`
+	Download int64  `json:"download"`
+}
+
+// ConnectionDiff is the change of connections since last sent
+type ConnectionDiff struct {
+	DownloadTotal int64               `json:"downloadTotal"`
+	UploadTotal   int64               `json:"uploadTotal"`
+	Opened        []tracker           `json:"opened"`
+	Closed        []string            `json:"closed"`
+	Updated       []*ConnectionUpdate `json:"updated"`
+}
+
+// Empty return whether the connections are unchanged
+func (d *ConnectionDiff) Empty() bool {
+	return len(d.Opened) == 0 && len(d.Closed) == 0 && len(d.Updated) == 0
+}
+
+// Differ remember the connections sent, and return the change of them
+type Differ struct {
+	query *ConnectionQuery
+	// the upload and download of connections sent
+	last map[string][2]int64
+}
+
+// Next return the change since last call, the first call return all as opened
+func (d *Differ) Next(m *Manager) *ConnectionDiff {
+	snapshot := m.Snapshot()
+	diff := &ConnectionDiff{
+		DownloadTotal: snapshot.DownloadTotal,
+		UploadTotal:   snapshot.UploadTotal,
+		Opened:        []tracker{},
+		Closed:        []string{},
+		Updated:       []*ConnectionUpdate{},
+	}
+
+	current := make(map[string][2]int64, len(d.last))
+	for _, c := range snapshot.Connections {
+		if d.query != nil && !d.query.Match(c) {
+			continue
+		}
+		info := c.info()
+		traffic := [2]int64{info.UploadTotal.Load(), info.DownloadTotal.Load()}
+		current[c.ID()] = traffic
+
+		last, ok := d.last[c.ID()]
+		switch {
+		case !ok:
+			diff.Opened = append(diff.Opened, c)
+		case last != traffic:
+			diff.Updated = append(diff.Updated, &ConnectionUpdate{
+				ID:       c.ID(),
+				Upload:   traffic[0],
+				Download: traffic[1],
+			})
+		}
+	}
+	for id := range d.last {
+		if _, ok := current[id]; !ok {
+			diff.Closed = append(diff.Closed, id)
+		}
+	}
+	d.last = current
+	return diff
+}
+
+func NewDiffer(q *ConnectionQuery) *Differ {
+	return &Differ{
+		query: q,
+		last:  map[string][2]int64{},
+	}
+}
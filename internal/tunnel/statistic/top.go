@@ -0,0 +1,230 @@
+package statistic
+
+import (
+	"container/heap"
+	"fmt"
+	"github.com/xmapst/mixed-socks/internal/constant"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	TopByHost   = "host"
+	TopByIP     = "ip"
+	TopBySource = "source"
+	TopByUser   = "user"
+
+	// topCapacity is the keys counted by a sketch, the heavy hitters
+	// above 1/topCapacity of the traffic are guaranteed to be kept
+	topCapacity = 128
+	// MaxTopWindow is the longest window of the top talkers
+	MaxTopWindow = 24 * time.Hour
+)
+
+var topDimensions = []string{TopByHost, TopByIP, TopBySource, TopByUser}
+
+// TopEntry is the traffic of a key, the Bytes is overestimated by at most Error
+type TopEntry struct {
+	Key         string `json:"key"`
+	Bytes       int64  `json:"bytes"`
+	Connections int64  `json:"connections"`
+	Error       int64  `json:"error"`
+}
+
+// spaceSaving count the heavy hitters by bytes in bounded memory (Metwally et al.),
+// the entries are a min-heap by bytes so the eviction is O(log k)
+type spaceSaving struct {
+	index   map[string]int
+	entries []*TopEntry
+}
+
+func (s *spaceSaving) Len() int           { return len(s.entries) }
+func (s *spaceSaving) Less(i, j int) bool { return s.entries[i].Bytes < s.entries[j].Bytes }
+func (s *spaceSaving) Swap(i, j int) {
+	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+	s.index[s.entries[i].Key] = i
+	s.index[s.entries[j].Key] = j
+}
+
+// Push and Pop implement heap.Interface
+func (s *spaceSaving) Push(x any) {
+	e := x.(*TopEntry)
+	s.index[e.Key] = len(s.entries)
+	s.entries = append(s.entries, e)
+}
+
+func (s *spaceSaving) Pop() any {
+	n := len(s.entries)
+	e := s.entries[n-1]
+	s.entries = s.entries[:n-1]
+	delete(s.index, e.Key)
+	return e
+}
+
+func (s *spaceSaving) add(key string, bytes, connections int64) {
+	if i, ok := s.index[key]; ok {
+		e := s.entries[i]
+		e.Bytes += bytes
+		e.Connections += connections
+		heap.Fix(s, i)
+		return
+	}
+	if len(s.entries) < topCapacity {
+		heap.Push(s, &TopEntry{Key: key, Bytes: bytes, Connections: connections})
+		return
+	}
+
+	// replace the smallest, the new key inherits its bytes as the error
+	smallest := s.entries[0]
+	delete(s.index, smallest.Key)
+	s.entries[0] = &TopEntry{
+		Key:         key,
+		Bytes:       smallest.Bytes + bytes,
+		Connections: connections,
+		Error:       smallest.Bytes,
+	}
+	s.index[key] = 0
+	heap.Fix(s, 0)
+}
+
+func newSpaceSaving() *spaceSaving {
+	return &spaceSaving{index: map[string]int{}}
+}
+
+type topBucket struct {
+	start  time.Time
+	sketch *spaceSaving
+}
+
+// topTier keep the sketches of the recent buckets
+type topTier struct {
+	step    time.Duration
+	size    int
+	buckets []*topBucket
+}
+
+func (t *topTier) bucket(now time.Time) *topBucket {
+	start := now.Truncate(t.step)
+	if n := len(t.buckets); n != 0 && t.buckets[n-1].start.Equal(start) {
+		return t.buckets[n-1]
+	}
+
+	b := &topBucket{start: start, sketch: newSpaceSaving()}
+	t.buckets = append(t.buckets, b)
+	if len(t.buckets) > t.size {
+		t.buckets = t.buckets[len(t.buckets)-t.size:]
+	}
+	return b
+}
+
+// merge sum the buckets overlap the window
+func (t *topTier) merge(since time.Time) map[string]*TopEntry {
+	merged := map[string]*TopEntry{}
+	for _, b := range t.buckets {
+		if !b.start.Add(t.step).After(since) {
+			continue
+		}
+		for _, e := range b.sketch.entries {
+			m, ok := merged[e.Key]
+			if !ok {
+				m = &TopEntry{Key: e.Key}
+				merged[e.Key] = m
+			}
+			m.Bytes += e.Bytes
+			m.Connections += e.Connections
+			m.Error += e.Error
+		}
+	}
+	return merged
+}
+
+// topDimension is the tiers of a dimension, locked separately from the others
+type topDimension struct {
+	mux     sync.Mutex
+	minutes *topTier
+	hours   *topTier
+}
+
+func (d *topDimension) add(now time.Time, key string, bytes, connections int64) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.minutes.bucket(now).sketch.add(key, bytes, connections)
+	d.hours.bucket(now).sketch.add(key, bytes, connections)
+}
+
+// TopTalkers aggregate the bytes and connections by destination host,
+// destination ip, source ip and user, per minute for the last hour and
+// per hour for the last day
+type TopTalkers struct {
+	dimensions map[string]*topDimension
+}
+
+func (t *TopTalkers) add(metadata *constant.Metadata, bytes, connections int64) {
+	if bytes == 0 && connections == 0 {
+		return
+	}
+
+	keys := map[string]string{
+		TopByHost:   metadata.Host,
+		TopBySource: metadata.SrcIP.String(),
+		TopByUser:   metadata.User,
+	}
+	if metadata.DstIP != nil {
+		keys[TopByIP] = metadata.DstIP.String()
+	}
+
+	now := time.Now()
+	for dimension, key := range keys {
+		if key != "" {
+			t.dimensions[dimension].add(now, key, bytes, connections)
+		}
+	}
+}
+
+// Top return the keys of the dimension with the most bytes in the window
+func (t *TopTalkers) Top(dimension string, window time.Duration, limit int) ([]*TopEntry, error) {
+	d, ok := t.dimensions[dimension]
+	if !ok {
+		return nil, fmt.Errorf("unsupport dimension: %s", dimension)
+	}
+	if window <= 0 || window > MaxTopWindow {
+		return nil, fmt.Errorf("window should be in (0, %s]", MaxTopWindow)
+	}
+
+	since := time.Now().Add(-window)
+	d.mux.Lock()
+	tier := d.minutes
+	if window > time.Hour {
+		tier = d.hours
+	}
+	merged := tier.merge(since)
+	d.mux.Unlock()
+
+	entries := make([]*TopEntry, 0, len(merged))
+	for _, e := range merged {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Bytes != entries[j].Bytes {
+			return entries[i].Bytes > entries[j].Bytes
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if limit > 0 && limit < len(entries) {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func NewTopTalkers() *TopTalkers {
+	t := &TopTalkers{dimensions: map[string]*topDimension{}}
+	for _, dimension := range topDimensions {
+		t.dimensions[dimension] = &topDimension{
+			// one more bucket for the partial one at the start of window
+			minutes: &topTier{step: time.Minute, size: 61},
+			hours:   &topTier{step: time.Hour, size: 25},
+		}
+	}
+	return t
+}
@@ -2,6 +2,7 @@ package statistic
 
 import (
 	"github.com/gofrs/uuid"
+	"github.com/xmapst/mixed-socks/internal/component/metrics"
 	"github.com/xmapst/mixed-socks/internal/constant"
 	"go.uber.org/atomic"
 	"net"
@@ -11,6 +12,7 @@ import (
 type tracker interface {
 	ID() string
 	Close() error
+	info() *trackerInfo
 }
 
 type trackerInfo struct {
@@ -19,12 +21,27 @@ type trackerInfo struct {
 	UploadTotal   *atomic.Int64      `json:"upload"`
 	DownloadTotal *atomic.Int64      `json:"download"`
 	Start         time.Time          `json:"start"`
+	Chain         constant.Chain     `json:"chains"`
+
+	// pending is the bytes not counted by the top talkers yet
+	pending *atomic.Int64
+	// reason is why the connection closed
+	reason *atomic.String
+	// rollups is the traffic history of the user and outbound
+	rollups []*rollup
+}
+
+func (t *trackerInfo) info() *trackerInfo {
+	return t
 }
 
 type TcpTracker struct {
 	constant.Conn `json:"-"`
 	*trackerInfo
 	manager *Manager
+
+	uploadCounter   *metrics.Counter
+	downloadCounter *metrics.Counter
 }
 
 func (tt *TcpTracker) ID() string {
@@ -36,6 +53,9 @@ func (tt *TcpTracker) Read(b []byte) (int, error) {
 	download := int64(n)
 	tt.manager.PushDownloaded(download)
 	tt.DownloadTotal.Add(download)
+	tt.pending.Add(download)
+	tt.downloadCounter.Add(float64(download))
+	pushRollups(tt.rollups, 0, download)
 	return n, err
 }
 
@@ -44,6 +64,9 @@ func (tt *TcpTracker) Write(b []byte) (int, error) {
 	upload := int64(n)
 	tt.manager.PushUploaded(upload)
 	tt.UploadTotal.Add(upload)
+	tt.pending.Add(upload)
+	tt.uploadCounter.Add(float64(upload))
+	pushRollups(tt.rollups, upload, 0)
 	return n, err
 }
 
@@ -64,9 +87,14 @@ func NewTCPTracker(conn constant.Conn, manager *Manager, metadata *constant.Meta
 			Metadata:      metadata,
 			UploadTotal:   atomic.NewInt64(0),
 			DownloadTotal: atomic.NewInt64(0),
+			Chain:         conn.Chains(),
+			pending:       atomic.NewInt64(0),
+			reason:        atomic.NewString(""),
 		},
 	}
 
+	t.uploadCounter, t.downloadCounter = trafficCounters(metadata, conn.Chains())
+	t.rollups = manager.history.rollups(metadata.User, conn.Chains().String())
 	manager.Join(t)
 	return t
 }
@@ -75,6 +103,11 @@ type UdpTracker struct {
 	constant.PacketConn `json:"-"`
 	*trackerInfo
 	manager *Manager
+	// onClose release the NAT entry of the session
+	onClose func(pc constant.PacketConn)
+
+	uploadCounter   *metrics.Counter
+	downloadCounter *metrics.Counter
 }
 
 func (ut *UdpTracker) ID() string {
@@ -83,9 +116,13 @@ func (ut *UdpTracker) ID() string {
 
 func (ut *UdpTracker) ReadFrom(b []byte) (int, net.Addr, error) {
 	n, addr, err := ut.PacketConn.ReadFrom(b)
+	ut.readFailed(err)
 	download := int64(n)
 	ut.manager.PushDownloaded(download)
 	ut.DownloadTotal.Add(download)
+	ut.pending.Add(download)
+	ut.downloadCounter.Add(float64(download))
+	pushRollups(ut.rollups, 0, download)
 	return n, addr, err
 }
 
@@ -94,29 +131,57 @@ func (ut *UdpTracker) WriteTo(b []byte, addr net.Addr) (int, error) {
 	upload := int64(n)
 	ut.manager.PushUploaded(upload)
 	ut.UploadTotal.Add(upload)
+	ut.pending.Add(upload)
+	ut.uploadCounter.Add(float64(upload))
+	pushRollups(ut.rollups, upload, 0)
 	return n, err
 }
 
 func (ut *UdpTracker) Close() error {
 	ut.manager.Leave(ut)
+	if ut.onClose != nil {
+		ut.onClose(ut)
+	}
 	return ut.PacketConn.Close()
 }
 
-func NewUDPTracker(conn constant.PacketConn, manager *Manager, metadata *constant.Metadata) *UdpTracker {
+// NewUDPTracker track the session, onClose is called with the tracker when closed, may be nil
+func NewUDPTracker(conn constant.PacketConn, manager *Manager, metadata *constant.Metadata, onClose func(pc constant.PacketConn)) *UdpTracker {
 	v4, _ := uuid.NewV4()
 
 	ut := &UdpTracker{
 		PacketConn: conn,
 		manager:    manager,
+		onClose:    onClose,
 		trackerInfo: &trackerInfo{
 			UUID:          v4,
 			Start:         time.Now(),
 			Metadata:      metadata,
 			UploadTotal:   atomic.NewInt64(0),
 			DownloadTotal: atomic.NewInt64(0),
+			Chain:         conn.Chains(),
+			pending:       atomic.NewInt64(0),
+			reason:        atomic.NewString(""),
 		},
 	}
 
+	ut.uploadCounter, ut.downloadCounter = trafficCounters(metadata, conn.Chains())
+	ut.rollups = manager.history.rollups(metadata.User, conn.Chains().String())
 	manager.Join(ut)
 	return ut
 }
+
+// trafficCounters count the connection and return the traffic counters of it
+func trafficCounters(metadata *constant.Metadata, chains constant.Chain) (upload, download *metrics.Counter) {
+	inbound, outbound := metadata.Type.String(), chains.String()
+	metrics.Connections.With(metadata.NetWork.String(), inbound).Inc()
+	upload = metrics.TrafficBytes.With("up", inbound, outbound, metadata.User)
+	download = metrics.TrafficBytes.With("down", inbound, outbound, metadata.User)
+	return
+}
+
+func pushRollups(rollups []*rollup, up, down int64) {
+	for _, r := range rollups {
+		r.push(up, down)
+	}
+}
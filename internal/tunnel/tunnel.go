@@ -6,6 +6,7 @@ import (
 	"github.com/xmapst/mixed-socks/internal/adapter"
 	"github.com/xmapst/mixed-socks/internal/adapter/inbound"
 	"github.com/xmapst/mixed-socks/internal/adapter/outbound"
+	"github.com/xmapst/mixed-socks/internal/component/metrics"
 	"github.com/xmapst/mixed-socks/internal/component/nat"
 	"github.com/xmapst/mixed-socks/internal/component/resolver"
 	"github.com/xmapst/mixed-socks/internal/constant"
@@ -14,6 +15,7 @@ import (
 	"net"
 	"net/netip"
 	"runtime"
+	"sync"
 	"time"
 )
 
@@ -21,7 +23,11 @@ var (
 	tcpQueue = make(chan constant.ConnContext, 65535)
 	udpQueue = make(chan *inbound.PacketAdapter, 65535)
 	natTable = nat.New()
-	proxies  = adapter.NewProxy(outbound.NewDirect())
+	direct   = adapter.NewProxy(outbound.NewDirect())
+	proxies  = map[string]constant.Proxy{direct.Name(): direct}
+
+	// lock for proxies
+	configMux sync.RWMutex
 
 	// default timeout for UDP session
 	udpTimeout = 60 * time.Second
@@ -30,6 +36,11 @@ var (
 
 func init() {
 	go process()
+
+	metrics.Register(metrics.NewGaugeFunc("nat_table_size", "UDP sessions in the NAT table.",
+		func(observe func(v float64, values ...string)) {
+			observe(float64(natTable.Len()))
+		}))
 }
 
 // TCPIn return fan-in queue
@@ -42,6 +53,27 @@ func UDPIn() chan<- *inbound.PacketAdapter {
 	return udpQueue
 }
 
+// Proxies return all proxies
+func Proxies() map[string]constant.Proxy {
+	configMux.RLock()
+	defer configMux.RUnlock()
+	return proxies
+}
+
+// UpdateProxies handle update proxies, DIRECT is always available.
+// newProxies is copied, it is owned by the config
+func UpdateProxies(newProxies map[string]constant.Proxy) {
+	copied := make(map[string]constant.Proxy, len(newProxies)+1)
+	for name, proxy := range newProxies {
+		copied[name] = proxy
+	}
+	copied[direct.Name()] = direct
+
+	configMux.Lock()
+	defer configMux.Unlock()
+	proxies = copied
+}
+
 // processUDP starts a loop to handle udp packet
 func processUDP() {
 	queue := udpQueue
@@ -85,9 +117,9 @@ func preHandleMetadata(metadata *constant.Metadata) error {
 		host, exist := resolver.FindHostByIP(metadata.DstIP)
 		if exist {
 			metadata.Host = host
-			if node := resolver.DefaultHosts.Search(host); node != nil {
+			if ips, _ := resolver.LookupHosts(host); len(ips) != 0 {
 				// redir-host should lookup the hosts
-				metadata.DstIP = node.Data.(net.IP)
+				metadata.DstIP = ips[0]
 			}
 		}
 	}
@@ -95,6 +127,18 @@ func preHandleMetadata(metadata *constant.Metadata) error {
 	return nil
 }
 
+// translateNAT64 dial the ipv4 embedded in the address synthesized by DNS64,
+// return the synthesized address, nil if not translated
+func translateNAT64(metadata *constant.Metadata) net.IP {
+	v4 := resolver.ExtractIPv4(resolver.DefaultNAT64Prefix, metadata.DstIP)
+	if v4 == nil {
+		return nil
+	}
+	synthesized := metadata.DstIP
+	metadata.DstIP = v4
+	return synthesized
+}
+
 func handleUDPConn(packet *inbound.PacketAdapter) {
 	metadata := packet.Metadata()
 	if !metadata.Valid() {
@@ -106,6 +150,14 @@ func handleUDPConn(packet *inbound.PacketAdapter) {
 		return
 	}
 
+	synthesized := translateNAT64(metadata)
+
+	if handler := shouldHijack(metadata); handler != nil {
+		logrus.Debugf("[UDP] %s --> %s hijacked", metadata.SourceAddress(), metadata.RemoteAddress())
+		go hijackUDP(packet, metadata, handler)
+		return
+	}
+
 	// local resolve UDP dns
 	if !metadata.Resolved() {
 		ips, err := resolver.LookupIP(context.Background(), metadata.Host)
@@ -152,21 +204,32 @@ func handleUDPConn(packet *inbound.PacketAdapter) {
 		pCtx := icontext.NewPacketConnContext(metadata)
 		ctx, cancel := context.WithTimeout(context.Background(), constant.DefaultUDPTimeout)
 		defer cancel()
-		rawPc, err := proxies.ListenPacketContext(ctx, metadata.Pure())
+		start := time.Now()
+		rawPc, err := direct.ListenPacketContext(ctx, metadata.Pure())
+		observeDial(metadata, start, err)
 		if err != nil {
+			statistic.DefaultManager.DialFailed(metadata, start, err)
 			logrus.Warnf("[UDP] dial %s --> %s error: %s", metadata.SourceAddress(), metadata.RemoteAddress(), err.Error())
 			return
 		}
 
 		pCtx.InjectPacketConn(rawPc)
-		pc := statistic.NewUDPTracker(rawPc, statistic.DefaultManager, metadata)
+		metadata.RemoteDst = metadata.UDPAddr().String()
+		// closed by the api, tear down the session at once
+		pc := statistic.NewUDPTracker(rawPc, statistic.DefaultManager, metadata, func(pc constant.PacketConn) {
+			natTable.DeleteIf(key, pc)
+		})
 		logrus.Infof("[UDP] %s --> %s", metadata.SourceAddress(), metadata.RemoteAddress())
 
 		oAddr, _ := netip.AddrFromSlice(metadata.DstIP)
+		// reply from the address the client sent to
+		if synthesized != nil {
+			oAddr, _ = netip.AddrFromSlice(synthesized)
+		}
 		oAddr = oAddr.Unmap()
+		natTable.Set(key, pc)
 		go handleUDPToLocal(packet.UDPPacket, pc, key, oAddr)
 
-		natTable.Set(key, pc)
 		handle()
 	}()
 }
@@ -186,14 +249,25 @@ func handleTCPConn(connCtx constant.ConnContext) {
 		logrus.Debugf("[Metadata PreHandle] error: %s", err)
 		return
 	}
+	translateNAT64(metadata)
+
+	if handler := shouldHijack(metadata); handler != nil {
+		logrus.Debugf("[%s] %s --> %s hijacked", metadata.Type.String(), metadata.SourceAddress(), metadata.RemoteAddress())
+		hijackTCP(connCtx.Conn(), metadata, handler)
+		return
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), constant.DefaultTCPTimeout)
 	defer cancel()
-	remoteConn, err := proxies.DialContext(ctx, metadata.Pure())
+	start := time.Now()
+	remoteConn, err := direct.DialContext(ctx, metadata.Pure())
+	observeDial(metadata, start, err)
 	if err != nil {
+		statistic.DefaultManager.DialFailed(metadata, start, err)
 		logrus.Warnf("[%s] %s --> %s error: %s", metadata.Type.String(), metadata.SourceAddress(), metadata.RemoteAddress(), err.Error())
 		return
 	}
+	metadata.RemoteDst = remoteConn.RemoteAddr().String()
 	remoteConn = statistic.NewTCPTracker(remoteConn, statistic.DefaultManager, metadata)
 	defer func(remoteConn constant.Conn) {
 		_ = remoteConn.Close()
@@ -202,3 +276,11 @@ func handleTCPConn(connCtx constant.ConnContext) {
 	logrus.Infof("[%s] %s --> %s", metadata.Type.String(), metadata.SourceAddress(), metadata.RemoteAddress())
 	handleSocket(connCtx, remoteConn)
 }
+
+func observeDial(metadata *constant.Metadata, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	metrics.DialDuration.With(metadata.NetWork.String(), result).Observe(time.Since(start).Seconds())
+}